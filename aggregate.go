@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// built-in aggregate types
+const (
+	aggregateCount     = "count"     // counts successes and failures
+	aggregateSum       = "sum"       // sums a numeric field
+	aggregateMin       = "min"       // the min of a numeric field
+	aggregateMax       = "max"       // the max of a numeric field
+	aggregateHistogram = "histogram" // counts values of a field, or numbers in buckets
+	aggregateGroupBy   = "groupBy"   // lists keys by value of a field
+	aggregateDistinct  = "distinct"  // lists distinct values of a field
+)
+
+// aggregateJSON declares a built-in aggregate of a job. Path is a JSON path in outputs,
+// as returned by GET /job/{id}/output, like $.value.status
+type aggregateJSON struct {
+	Type    string    `json:"type"`
+	Path    string    `json:"path"`
+	Buckets []float64 `json:"buckets"` // histogram: upper bounds of number buckets, values are counted by value without
+}
+
+// aggregate is computed as outputs are received
+type aggregate struct {
+	options   aggregateJSON
+	path      jsonPath
+	successes int64
+	failures  int64
+	number    *float64            // sum, min or max, nil until a number is found
+	counts    map[string]int64    // histogram by value
+	buckets   []int64             // histogram in buckets, the last one counts values above the last bound
+	groups    map[string][]string // groupBy
+	distinct  map[string]interface{}
+}
+
+// aggregates are the built-in aggregates of a job, by name
+type aggregates struct {
+	sync.Mutex
+	byName map[string]*aggregate
+}
+
+// newAggregates checks the built-in aggregates of a job
+func newAggregates(options map[string]aggregateJSON) (*aggregates, error) {
+	result := &aggregates{byName: make(map[string]*aggregate)}
+	for name, each := range options {
+		agg := &aggregate{options: each}
+		switch each.Type {
+		case aggregateCount:
+		case aggregateSum, aggregateMin, aggregateMax, aggregateGroupBy:
+		case aggregateDistinct:
+			agg.distinct = make(map[string]interface{})
+		case aggregateHistogram:
+			if !sort.Float64sAreSorted(each.Buckets) {
+				return nil, fmt.Errorf("Buckets of aggregate %s must be sorted", name)
+			}
+			if len(each.Buckets) > 0 {
+				agg.buckets = make([]int64, len(each.Buckets)+1)
+			} else {
+				agg.counts = make(map[string]int64)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown type %q for aggregate %s", each.Type, name)
+		}
+		if each.Type == aggregateGroupBy {
+			agg.groups = make(map[string][]string)
+		}
+		if each.Type != aggregateCount {
+			path, err := parseJSONPath(each.Path)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid path for aggregate %s: %v", name, err)
+			}
+			agg.path = path
+		}
+		result.byName[name] = agg
+	}
+	return result, nil
+}
+
+// add updates the aggregates with an output
+func (aggs *aggregates) add(output *Output) {
+	document, err := outputDocument(output)
+	if err != nil {
+		return
+	}
+
+	aggs.Lock()
+	defer aggs.Unlock()
+	for _, agg := range aggs.byName {
+		if agg.options.Type == aggregateCount {
+			if output.Error != nil {
+				agg.failures++
+			} else {
+				agg.successes++
+			}
+			continue
+		}
+		if value, ok := agg.path.lookup(document); ok {
+			agg.addValue(output.Key, value)
+		}
+	}
+}
+
+// addValue updates an aggregate with the value found in an output
+func (agg *aggregate) addValue(key string, value interface{}) {
+	number, isNumber := 0.0, false
+	if typed, ok := value.(json.Number); ok {
+		var err error
+		number, err = typed.Float64()
+		isNumber = err == nil
+	}
+	switch agg.options.Type {
+	case aggregateSum, aggregateMin, aggregateMax:
+		if !isNumber {
+			return
+		}
+		switch {
+		case agg.number == nil:
+			agg.number = &number
+		case agg.options.Type == aggregateSum:
+			*agg.number += number
+		case agg.options.Type == aggregateMin && number < *agg.number, agg.options.Type == aggregateMax && number > *agg.number:
+			*agg.number = number
+		}
+	case aggregateHistogram:
+		if agg.buckets == nil {
+			agg.counts[valueLabel(value)]++
+		} else if isNumber {
+			agg.buckets[sort.Search(len(agg.options.Buckets), func(index int) bool { return number < agg.options.Buckets[index] })]++
+		}
+	case aggregateGroupBy:
+		label := valueLabel(value)
+		agg.groups[label] = append(agg.groups[label], key)
+	case aggregateDistinct:
+		agg.distinct[valueLabel(value)] = value
+	}
+}
+
+// valueLabel returns a string for a JSON value: strings as is, other values as JSON
+func valueLabel(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+// values returns the current value of each aggregate, by name
+func (aggs *aggregates) values() map[string]interface{} {
+	aggs.Lock()
+	defer aggs.Unlock()
+	result := make(map[string]interface{}, len(aggs.byName))
+	for name, agg := range aggs.byName {
+		result[name] = agg.value()
+	}
+	return result
+}
+
+// value returns a copy of the current value of an aggregate
+func (agg *aggregate) value() interface{} {
+	switch agg.options.Type {
+	case aggregateCount:
+		return map[string]int64{"successes": agg.successes, "failures": agg.failures}
+	case aggregateSum, aggregateMin, aggregateMax:
+		if agg.number == nil {
+			return nil
+		}
+		return *agg.number
+	case aggregateHistogram:
+		if agg.buckets == nil {
+			counts := make(map[string]int64, len(agg.counts))
+			for label, count := range agg.counts {
+				counts[label] = count
+			}
+			return counts
+		}
+		return map[string]interface{}{"buckets": agg.options.Buckets, "counts": append([]int64(nil), agg.buckets...)}
+	case aggregateGroupBy:
+		groups := make(map[string][]string, len(agg.groups))
+		for label, keys := range agg.groups {
+			groups[label] = append([]string(nil), keys...)
+		}
+		return groups
+	default:
+		labels := make([]string, 0, len(agg.distinct))
+		for label := range agg.distinct {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		values := make([]interface{}, len(labels))
+		for index, label := range labels {
+			values[index] = agg.distinct[label]
+		}
+		return values
+	}
+}
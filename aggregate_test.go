@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	var document interface{}
+	json.Unmarshal([]byte(`{"value":{"items":[{"name":"a"},{"name":"b"}]},"metadata":{"headers":{"X-Cache":"HIT"}}}`), &document)
+	for expression, expected := range map[string]interface{}{
+		"$.value.items[1].name":          "b",
+		"$.metadata.headers['X-Cache']":  "HIT",
+		`$["value"]["items"][0]["name"]`: "a",
+	} {
+		path, err := parseJSONPath(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := path.lookup(document); !ok || value != expected {
+			t.Fatalf("%s should be %v, not %v", expression, expected, value)
+		}
+	}
+	if path, _ := parseJSONPath("$.value.items[2]"); path != nil {
+		if _, ok := path.lookup(document); ok {
+			t.Fatal("missing values shouldn't be found")
+		}
+	}
+	for _, expression := range []string{"value", "$.", "$.a[", "$.a[-1]", "$a"} {
+		if _, err := parseJSONPath(expression); err == nil {
+			t.Fatalf("%s should be invalid", expression)
+		}
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	aggs, err := newAggregates(map[string]aggregateJSON{
+		"count":    {Type: aggregateCount},
+		"total":    {Type: aggregateSum, Path: "$.value.price"},
+		"cheapest": {Type: aggregateMin, Path: "$.value.price"},
+		"prices":   {Type: aggregateHistogram, Path: "$.value.price", Buckets: []float64{10, 100}},
+		"statuses": {Type: aggregateHistogram, Path: "$.value.status"},
+		"byStatus": {Type: aggregateGroupBy, Path: "$.value.status"},
+		"distinct": {Type: aggregateDistinct, Path: "$.value.status"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggs.add(&Output{Key: "a", Value: []byte(`{"price":5,"status":"ok"}`)})
+	aggs.add(&Output{Key: "b", Value: []byte(`{"price":50,"status":"ok"}`)})
+	aggs.add(&Output{Key: "c", Value: []byte(`{"price":500,"status":"sold out"}`)})
+	aggs.add(&Output{Key: "d", Error: &OutputError{StatusCode: 404}})
+
+	values, _ := json.Marshal(aggs.values())
+	expected := `{"byStatus":{"ok":["a","b"],"sold out":["c"]},"cheapest":5,"count":{"failures":1,"successes":3},` +
+		`"distinct":["ok","sold out"],"prices":{"buckets":[10,100],"counts":[1,1,1]},"statuses":{"ok":2,"sold out":1},"total":555}`
+	if string(values) != expected {
+		t.Fatalf("aggregates should be\n%s\nnot\n%s", expected, values)
+	}
+
+	if _, err := newAggregates(map[string]aggregateJSON{"x": {Type: "median", Path: "$.value"}}); err == nil {
+		t.Fatal("unknown aggregate types should be rejected")
+	}
+}
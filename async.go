@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultAsyncDeadline is how long PMmap waits for the callback of an input by default
+const defaultAsyncDeadline = time.Hour
+
+// asyncJSON lets the webhook reply 202 Accepted at once, and send the reply later
+// with POST /job/{id}/output/{key}
+type asyncJSON struct {
+	Deadline string `json:"deadline"` // max time between the webhook call and its callback, like "10m"
+}
+
+// asyncStatus counts the inputs waiting for their callback
+type asyncStatus struct {
+	Waiting int `json:"waiting"`
+}
+
+// callback is the reply of the webhook sent to POST /job/{id}/output/{key}
+type callback struct {
+	response *http.Response // status code and headers, the body is read already
+	body     []byte
+}
+
+// asyncCalls holds the inputs waiting for their callback, by key.
+// Their worker waits too, so they're counted against the job concurrency
+type asyncCalls struct {
+	sync.Mutex
+	deadline time.Duration
+	waiting  map[string][]chan *callback // inputs with the same key get callbacks in order
+}
+
+func newAsyncCalls(options *asyncJSON) (*asyncCalls, error) {
+	deadline := defaultAsyncDeadline
+	if options.Deadline != "" {
+		var err error
+		if deadline, err = time.ParseDuration(options.Deadline); err != nil || deadline <= 0 {
+			return nil, fmt.Errorf("Invalid async deadline %q", options.Deadline)
+		}
+	}
+	return &asyncCalls{deadline: deadline, waiting: make(map[string][]chan *callback)}, nil
+}
+
+// register adds a key waiting for its callback
+func (calls *asyncCalls) register(key string) chan *callback {
+	calls.Lock()
+	defer calls.Unlock()
+	result := make(chan *callback, 1)
+	calls.waiting[key] = append(calls.waiting[key], result)
+	return result
+}
+
+// unregister removes a key waiting for its callback, returns false if the callback was delivered already
+func (calls *asyncCalls) unregister(key string, waiting chan *callback) bool {
+	calls.Lock()
+	defer calls.Unlock()
+	for index, each := range calls.waiting[key] {
+		if each == waiting {
+			calls.remove(key, index)
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes a waiting channel, must be called with the lock held
+func (calls *asyncCalls) remove(key string, index int) {
+	rest := append(calls.waiting[key][:index:index], calls.waiting[key][index+1:]...)
+	if len(rest) == 0 {
+		delete(calls.waiting, key)
+	} else {
+		calls.waiting[key] = rest
+	}
+}
+
+// deliver sends a callback to the oldest input of the key, returns false if none is waiting
+func (calls *asyncCalls) deliver(key string, reply *callback) bool {
+	calls.Lock()
+	defer calls.Unlock()
+	if len(calls.waiting[key]) == 0 {
+		return false
+	}
+	calls.waiting[key][0] <- reply
+	calls.remove(key, 0)
+	return true
+}
+
+// count returns the number of inputs waiting for their callback
+func (calls *asyncCalls) count() int {
+	calls.Lock()
+	defer calls.Unlock()
+	count := 0
+	for _, each := range calls.waiting {
+		count += len(each)
+	}
+	return count
+}
+
+// awaitCallback waits for the callback of an input accepted by the webhook,
+// registered before the webhook call. Returns nil if there was none before the deadline, the input is then retried
+// or gets an error, or if the job is stopping, the input is then checkpointed
+func (job *Job) awaitCallback(input Input, waiting chan *callback) *callback {
+	timer := time.NewTimer(job.async.deadline)
+	defer timer.Stop()
+	select {
+	case reply := <-waiting:
+		return reply
+	case <-timer.C:
+	case <-job.quit:
+	}
+	if !job.async.unregister(input.Key, waiting) { // delivered meanwhile
+		return <-waiting
+	}
+
+	select {
+	case <-job.quit:
+		job.requeue(input)
+		return nil
+	default:
+	}
+	job.log(levelWarn, "no callback before the deadline", "key", input.Key, "attempt", input.retryCount+1, "deadline", job.async.deadline)
+	if input.retryCount < job.maxRetries {
+		input.retryCount++
+		job.requeue(input)
+	} else {
+		job.reply(Output{Key: input.Key, Error: &OutputError{Message: "No callback before the deadline"}})
+	}
+	return nil
+}
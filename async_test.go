@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/chrisDeFouRire/pmmap/signature"
+)
+
+// sendCallback posts the signed async reply of a key
+func sendCallback(jobID string, key string, body string) (*http.Response, error) {
+	req, _ := http.NewRequest("POST", "http://localhost:8080/job/"+jobID+"/output/"+key, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	signature.SignRequest(req, Secret, []byte(body), time.Now())
+	return http.DefaultClient.Do(req)
+}
+
+func TestAsync(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := path.Base(req.URL.Path)
+		if key == "early" { // calls back before replying
+			sendCallback(req.Header.Get("PMMAP-job"), key, `{"done":"early"}`)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if key == "a" {
+			go sendCallback(req.Header.Get("PMMAP-job"), key, `{"done":"`+key+`"}`)
+		}
+	}))
+	defer backend.Close()
+
+	noSecret, _ := json.Marshal(map[string]interface{}{"url": backend.URL, "async": map[string]string{}})
+	if res, _ := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(noSecret)); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("async jobs without secret should be rejected")
+	}
+	template, _ := json.Marshal(map[string]interface{}{"name": "unsigned", "job": map[string]interface{}{"url": backend.URL, "async": map[string]string{}}})
+	if res, _ := http.Post("http://localhost:8080/template", "application/json", bytes.NewReader(template)); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("async templates without secret should be rejected")
+	}
+
+	spec, _ := json.Marshal(map[string]interface{}{"secret": Secret, "url": backend.URL, "maxsize": 10, "concurrency": 1,
+		"maxRetries": 0, "async": map[string]string{"deadline": "200ms"}})
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(spec))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+
+	if res, err := sendCallback(job.ID, "a", `{}`); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatal("callbacks of keys which aren't waiting should be rejected")
+	}
+	unsigned, _ := http.Post("http://localhost:8080/job/"+job.ID+"/output/a", "application/json", nil)
+	if unsigned.StatusCode != http.StatusUnauthorized {
+		t.Fatal("unsigned callbacks should be rejected")
+	}
+
+	job.AddToJob("a", []byte(`1`))
+	job.AddToJob("late", []byte(`2`))
+	job.AddToJob("early", []byte(`3`))
+	job.AllInputsWereSent()
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete")
+	}
+
+	output, _ := job.GetOutput("a")
+	if output == nil || string(output.Value) != `{"done":"a"}` {
+		t.Fatalf("the output should be the callback body: %+v", output)
+	}
+	output, _ = job.GetOutput("early")
+	if output == nil || string(output.Value) != `{"done":"early"}` {
+		t.Fatalf("callbacks sent before the webhook replies should be kept: %+v", output)
+	}
+	output, _ = job.GetOutput("late")
+	if output == nil || output.Error == nil {
+		t.Fatalf("inputs without callback before the deadline should fail: %+v", output)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// attemptBodyLimit is the max number of bytes of a webhook reply kept in an attempt
+const attemptBodyLimit = 1024
+
+// Attempt records a single webhook call for an input
+type Attempt struct {
+	Number     int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	Latency    int64     `json:"latency"` // in milliseconds
+	StatusCode int       `json:"statusCode,omitempty"`
+	Body       string    `json:"body,omitempty"`  // truncated webhook reply
+	Error      string    `json:"error,omitempty"` // transport error
+}
+
+// attemptKey returns the storage key of an attempt, attempts of a key are sorted by number
+func attemptKey(key string, number int) []byte {
+	prefix := attemptsPrefix(key)
+	result := make([]byte, len(prefix)+4)
+	copy(result, prefix)
+	binary.BigEndian.PutUint32(result[len(prefix):], uint32(number))
+	return result
+}
+
+// attemptsPrefix returns the storage prefix of all attempts of a key
+func attemptsPrefix(key string) []byte {
+	return []byte(attemptPrefix + key + "\x00")
+}
+
+// newAttempt creates the attempt record of a webhook call
+func newAttempt(input Input, start time.Time, latency time.Duration, statusCode int, body []byte, err error) *Attempt {
+	attempt := &Attempt{
+		Number:     input.retryCount + 1,
+		Time:       start.UTC(),
+		Latency:    latency.Nanoseconds() / int64(time.Millisecond),
+		StatusCode: statusCode,
+	}
+	if len(body) > attemptBodyLimit {
+		body = body[:attemptBodyLimit]
+	}
+	attempt.Body = string(body)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	return attempt
+}
+
+// recordAttempt stores an attempt, and deletes the oldest one beyond the retention limit
+func (job *Job) recordAttempt(key string, attempt *Attempt) {
+	if job.attemptsRetention <= 0 {
+		return
+	}
+	b, _ := json.Marshal(attempt)
+	if err := job.store(attemptKey(key, attempt.Number), b); err != nil {
+		job.log(levelWarn, "can't store attempt", "key", key, "attempt", attempt.Number, "error", err)
+		return
+	}
+	if old := attempt.Number - job.attemptsRetention; old > 0 {
+		job.remove(attemptKey(key, old))
+	}
+}
+
+// GetAttempts returns the attempts recorded for a key, oldest first
+func (job *Job) GetAttempts(key string) ([]*Attempt, error) {
+	result := []*Attempt{}
+	iter := job.outputsDB.NewIterator(util.BytesPrefix(attemptsPrefix(key)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		attempt := &Attempt{}
+		if err := json.Unmarshal(iter.Value(), attempt); err != nil {
+			return nil, err
+		}
+		result = append(result, attempt)
+	}
+	return result, iter.Error()
+}
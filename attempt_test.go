@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// TestAttempts tests that webhook attempts are recorded, within the retention limit
+func TestAttempts(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("try again"))
+			return
+		}
+		w.Write([]byte(`"done"`))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.attemptsRetention = 2
+	job.Start(1)
+	job.AddToJob("a/key", []byte(`"value"`))
+	job.AllInputsWereSent()
+	<-job.Complete
+
+	attempts, err := job.GetAttempts("a/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("only the last 2 attempts should be kept, there are %d", len(attempts))
+	}
+	if attempts[0].Number != 2 || attempts[0].StatusCode != http.StatusBadGateway || attempts[0].Body != "try again" {
+		t.Fatalf("second attempt isn't right: %+v", attempts[0])
+	}
+	if attempts[1].Number != 3 || attempts[1].StatusCode != http.StatusOK {
+		t.Fatalf("third attempt isn't right: %+v", attempts[1])
+	}
+	if string(job.GetResult("a/key")) != `"done"` {
+		t.Fatalf("result should been returned (%s)", string(job.GetResult("a/key")))
+	}
+}
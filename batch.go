@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/chrisDeFouRire/pmmap/signature"
+)
+
+// defaultBatchWait is how long a worker waits to fill a batch by default
+const defaultBatchWait = 100 * time.Millisecond
+
+// batchResultJSON is the result of an input in the reply of a batch
+type batchResultJSON struct {
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value"`
+	Encoding    string          `json:"encoding"`
+	ContentType string          `json:"contentType"`
+	Error       string          `json:"error"` // the input failed, it's retried
+}
+
+// checkBatches checks the batch options of a job
+func checkBatches(query *createJobJSON, request *webhookRequest) (time.Duration, error) {
+	wait := defaultBatchWait
+	if query.BatchSize < 0 || query.BatchWait < 0 {
+		return 0, fmt.Errorf("batchSize and batchWait can't be negative")
+	}
+	if query.BatchSize < 2 {
+		return wait, nil
+	}
+	if query.BatchWait > 0 {
+		wait = time.Duration(query.BatchWait) * time.Millisecond
+	}
+	switch {
+	case query.Pull != nil || query.Async != nil || query.FanOut != nil:
+		return 0, fmt.Errorf("batchSize can't be used with pull, async or fanOut")
+	case request.method == "GET":
+		return 0, fmt.Errorf("Batches can't be sent with GET")
+	case request.body != nil:
+		return 0, fmt.Errorf("Batches can't have a body template")
+	case strings.Contains(request.raw, keyPlaceholder):
+		return 0, fmt.Errorf("Batches are sent to the webhook url, it can't have a %s placeholder", keyPlaceholder)
+	}
+	return wait, nil
+}
+
+// processBatch sends a batch of inputs to the webhook in a single call. Each input gets
+// the result of its key in the reply, inputs without result are retried like failed inputs
+func (job *Job) processBatch(inputs []Input) {
+	req, body, errRequest := job.request.newBatchRequest(inputs)
+	if errRequest != nil {
+		job.log(levelWarn, "can't create webhook batch request", "inputs", len(inputs), "error", errRequest)
+		for _, input := range inputs {
+			job.reply(Output{Key: input.Key, Error: &OutputError{Message: "Can't create request to the backend endpoint: " + errRequest.Error()}})
+		}
+		return
+	}
+	req.Header.Add("PMMAP-job", job.ID)
+	if job.plaintext {
+		req.Header.Add("PMMAP-auth", job.secretKey)
+	}
+	signature.SignRequest(req, job.secretKey, body, time.Now())
+	if !Scheduler.acquire(job, job.quit) { // stopping, the inputs are checkpointed
+		for _, input := range inputs {
+			job.requeue(input)
+		}
+		return
+	}
+	start := time.Now()
+	res, errResponse := job.client.Do(req)
+	latency := time.Since(start)
+	Scheduler.release(job)
+	if errResponse != nil {
+		job.log(levelWarn, "webhook batch call failed", "inputs", len(inputs), "latency", latency, "error", errResponse)
+		for _, input := range inputs {
+			job.recordAttempt(input.Key, newAttempt(input, start, latency, 0, nil, errResponse))
+			input.retryCount++
+			job.requeue(input)
+		}
+		return
+	}
+	defer res.Body.Close()
+	job.log(levelDebug, "webhook batch called", "inputs", len(inputs), "status", res.StatusCode, "latency", latency)
+
+	replyBody, readerr := ioutil.ReadAll(res.Body)
+	for _, input := range inputs {
+		job.recordAttempt(input.Key, newAttempt(input, start, latency, res.StatusCode, replyBody, readerr))
+	}
+	var results []batchResultJSON
+	if readerr == nil && job.isSuccess(res.StatusCode) {
+		if err := json.Unmarshal(replyBody, &results); err != nil {
+			readerr = fmt.Errorf("Invalid batch reply: %v", err)
+		}
+	}
+	if readerr != nil || !job.isSuccess(res.StatusCode) {
+		job.log(levelWarn, "webhook rejected batch", "inputs", len(inputs), "status", res.StatusCode, "latency", latency, "error", readerr)
+		failure := &OutputError{StatusCode: res.StatusCode, Body: string(replyBody)}
+		if readerr != nil {
+			failure.Message = readerr.Error()
+		}
+		for _, input := range inputs {
+			job.failBatchInput(input, res.StatusCode, failure)
+		}
+		return
+	}
+
+	byKey := make(map[string][]batchResultJSON, len(results))
+	for _, result := range results {
+		byKey[result.Key] = append(byKey[result.Key], result)
+	}
+	for _, input := range inputs {
+		found := byKey[input.Key]
+		if len(found) == 0 {
+			job.failBatchInput(input, res.StatusCode, &OutputError{Message: "No result in the batch reply"})
+			continue
+		}
+		result := found[0]
+		byKey[input.Key] = found[1:]
+		if result.Error != "" {
+			job.failBatchInput(input, res.StatusCode, &OutputError{Message: result.Error})
+			continue
+		}
+		value, err := decodeValue(result.Value, result.Encoding)
+		if err != nil {
+			job.failBatchInput(input, res.StatusCode, &OutputError{Message: fmt.Sprintf("Invalid value in the batch reply: %v", err)})
+			continue
+		}
+		output := Output{Key: input.Key, ContentType: result.ContentType}
+		if len(value) > 0 {
+			output.Value = value
+		}
+		if output.ContentType == "" && (result.Encoding == "" || result.Encoding == encodingJSON) {
+			output.ContentType = "application/json"
+		}
+		if job.metadata {
+			output.Metadata = job.newMetadata(res, latency)
+		}
+		job.reply(output)
+	}
+}
+
+// failBatchInput retries an input which failed in a batch, or gives it an output error
+// once it can't be retried anymore, like process does for single inputs
+func (job *Job) failBatchInput(input Input, statusCode int, failure *OutputError) {
+	if statusCode >= 500 || input.retryCount < job.maxRetries {
+		input.retryCount++
+		job.requeue(input)
+		return
+	}
+	job.log(levelWarn, "input failed in batch", "key", input.Key, "attempt", input.retryCount+1, "status", statusCode, "error", failure.Message)
+	job.reply(Output{Key: input.Key, Error: failure})
+}
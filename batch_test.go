@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatches(t *testing.T) {
+	var lock sync.Mutex
+	var sizes []int
+	flaky := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var batch []inputJSON
+		json.NewDecoder(req.Body).Decode(&batch)
+		lock.Lock()
+		defer lock.Unlock()
+		sizes = append(sizes, len(batch))
+		results := []map[string]interface{}{}
+		for _, input := range batch {
+			switch {
+			case input.Key == "missing":
+			case input.Key == "flaky" && flaky:
+				flaky = false
+				results = append(results, map[string]interface{}{"key": input.Key, "error": "try again"})
+			default:
+				results = append(results, map[string]interface{}{"key": input.Key, "value": map[string]json.RawMessage{"got": input.Value}})
+			}
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer backend.Close()
+
+	spec, _ := json.Marshal(map[string]interface{}{"secret": Secret, "url": backend.URL + "/batch", "maxsize": 10, "concurrency": 1,
+		"maxRetries": 1, "batchSize": 3, "batchWait": 50})
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(spec))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	job.AddInputsToJob([]Input{{Key: "a", Value: []byte(`1`)}, {Key: "flaky", Value: []byte(`2`)},
+		{Key: "missing", Value: []byte(`3`)}, {Key: "b", Value: []byte(`"4"`)}})
+	job.AllInputsWereSent()
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete")
+	}
+
+	for key, expected := range map[string]string{"a": `{"got":1}`, "flaky": `{"got":2}`, "b": `{"got":"4"}`} {
+		if output, _ := job.GetOutput(key); output == nil || string(output.Value) != expected || output.ContentType != "application/json" {
+			t.Fatalf("output of %s should be %s: %+v", key, expected, output)
+		}
+	}
+	if output, _ := job.GetOutput("missing"); output == nil || output.Error == nil {
+		t.Fatalf("inputs without result should fail once retried: %+v", output)
+	}
+	total := 0
+	for _, size := range sizes {
+		if size > 3 {
+			t.Fatalf("batches should have 3 inputs at most: %v", sizes)
+		}
+		total += size
+	}
+	if total != 6 || len(sizes) >= total {
+		t.Fatalf("4 inputs and 2 retries should be sent in batches: %v", sizes)
+	}
+
+	spec, _ = json.Marshal(map[string]interface{}{"secret": Secret, "url": backend.URL + "/{key}", "maxsize": 10, "batchSize": 3})
+	if res, _ := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(spec)); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("batches can't be sent to a url with a key placeholder")
+	}
+}
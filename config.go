@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the server settings.
+// They're read from defaults, then an optional YAML file, then PMMAP_* environment variables, then flags
+type Config struct {
+	ListenAddress       string        `yaml:"listen"`
+	DataDir             string        `yaml:"dataDir"`
+	TLSCertFile         string        `yaml:"tlsCert"`
+	TLSKeyFile          string        `yaml:"tlsKey"`
+	TLSClientCAFile     string        `yaml:"tlsClientCA"`
+	JobTimeout          time.Duration `yaml:"jobTimeout"`          // default timeout of webhook calls
+	MaxRetries          int           `yaml:"maxRetries"`          // default max number of retries of an input
+	AttemptsRetention   int           `yaml:"attemptsRetention"`   // default max number of webhook attempts recorded per key
+	MaxJobs             int           `yaml:"maxJobs"`             // max number of jobs on the server, 0 for unlimited
+	MaxConcurrency      int           `yaml:"maxConcurrency"`      // max concurrency of a job, 0 for unlimited
+	MaxInflight         int64         `yaml:"maxInflight"`         // max number of concurrent webhook calls, 0 for unlimited
+	ShutdownGrace       time.Duration `yaml:"shutdownGrace"`       // how long in-flight webhook calls may last after SIGTERM
+	LogLevel            string        `yaml:"logLevel"`            // debug, info, warn or error
+	LogFormat           string        `yaml:"logFormat"`           // logfmt or json
+	AllowedWebhookHosts hostList      `yaml:"allowedWebhookHosts"` // hosts jobs may call, all hosts if empty
+	SinkDir             string        `yaml:"sinkDir"`             // directory of file sinks, file sinks are disabled if empty
+	InputDir            string        `yaml:"inputDir"`            // directory of file input sources, file sources are disabled if empty
+	AdminToken          string        `yaml:"adminToken"`          // token of PUT /tenant/{id}, tenants can't be declared if empty
+	DefaultMaxJobs      int64         `yaml:"defaultMaxJobs"`      // quotas of the default tenant, 0 for unlimited
+	DefaultMaxInflight  int64         `yaml:"defaultMaxInflight"`
+	DefaultMaxQueued    int64         `yaml:"defaultMaxQueuedInputs"`
+	DefaultMaxDiskUsage int64         `yaml:"defaultMaxDiskUsage"`
+}
+
+// config is the server configuration, defaults until loadConfig is called
+var config = defaultConfig()
+
+// defaultConfig returns the default settings, some of them can be set at build time
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:     ListenAddress,
+		DataDir:           "./db/",
+		TLSCertFile:       TLSCertFile,
+		TLSKeyFile:        TLSKeyFile,
+		TLSClientCAFile:   TLSClientCAFile,
+		JobTimeout:        30 * time.Second,
+		MaxRetries:        5,
+		AttemptsRetention: 10,
+		ShutdownGrace:     25 * time.Second,
+		LogLevel:          "info",
+		LogFormat:         "logfmt",
+	}
+}
+
+// hostList is a list of hosts, set from a comma separated string in flags and environment variables
+type hostList []string
+
+func (hosts *hostList) String() string {
+	return strings.Join(*hosts, ",")
+}
+
+func (hosts *hostList) Set(value string) error {
+	*hosts = nil
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			*hosts = append(*hosts, host)
+		}
+	}
+	return nil
+}
+
+// allows tells if a webhook host is in the list. "*.example.com" allows all subdomains of example.com
+func (hosts hostList) allows(host string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfig reads the configuration from a file, the environment and command line arguments
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+	result := defaultConfig()
+
+	flags := flag.NewFlagSet("pmmap", flag.ContinueOnError)
+	path := flags.String("config", getenv("PMMAP_CONFIG"), "YAML configuration file (env PMMAP_CONFIG)")
+	flags.StringVar(&result.ListenAddress, "listen", result.ListenAddress, "address to listen to")
+	flags.StringVar(&result.DataDir, "data-dir", result.DataDir, "directory storing job outputs")
+	flags.StringVar(&result.TLSCertFile, "tls-cert", result.TLSCertFile, "PEM certificate, serves the API over TLS")
+	flags.StringVar(&result.TLSKeyFile, "tls-key", result.TLSKeyFile, "PEM private key of the certificate")
+	flags.StringVar(&result.TLSClientCAFile, "tls-client-ca", result.TLSClientCAFile, "PEM CA bundle, API clients must present a certificate signed by it")
+	flags.DurationVar(&result.JobTimeout, "job-timeout", result.JobTimeout, "default timeout of webhook calls")
+	flags.IntVar(&result.MaxRetries, "max-retries", result.MaxRetries, "default max number of retries of an input")
+	flags.IntVar(&result.AttemptsRetention, "attempts-retention", result.AttemptsRetention, "default max number of webhook attempts recorded per key, 0 to disable")
+	flags.IntVar(&result.MaxJobs, "max-jobs", result.MaxJobs, "max number of jobs, 0 for unlimited")
+	flags.IntVar(&result.MaxConcurrency, "max-concurrency", result.MaxConcurrency, "max concurrency of a job, 0 for unlimited")
+	flags.Int64Var(&result.MaxInflight, "max-inflight", result.MaxInflight, "max number of concurrent webhook calls, 0 for unlimited")
+	flags.DurationVar(&result.ShutdownGrace, "shutdown-grace", result.ShutdownGrace, "how long in-flight webhook calls may last after SIGTERM")
+	flags.StringVar(&result.LogLevel, "log-level", result.LogLevel, "debug, info, warn or error")
+	flags.StringVar(&result.LogFormat, "log-format", result.LogFormat, "logfmt or json")
+	flags.Var(&result.AllowedWebhookHosts, "allowed-webhook-hosts", "comma separated hosts jobs may call, *.example.com allows subdomains")
+	flags.StringVar(&result.SinkDir, "sink-dir", result.SinkDir, "directory where jobs may write their outputs, file sinks are disabled if empty")
+	flags.StringVar(&result.InputDir, "input-dir", result.InputDir, "directory where jobs may read their inputs, file sources are disabled if empty")
+	flags.StringVar(&result.AdminToken, "admin-token", result.AdminToken, "token declaring tenants with PUT /tenant/{id}, tenants can't be declared if empty")
+	flags.Int64Var(&result.DefaultMaxJobs, "default-max-jobs", result.DefaultMaxJobs, "max number of running jobs of the default tenant, 0 for unlimited")
+	flags.Int64Var(&result.DefaultMaxInflight, "default-max-inflight", result.DefaultMaxInflight, "max number of concurrent webhook calls of the default tenant, 0 for unlimited")
+	flags.Int64Var(&result.DefaultMaxQueued, "default-max-queued-inputs", result.DefaultMaxQueued, "max number of queued inputs of the default tenant, 0 for unlimited")
+	flags.Int64Var(&result.DefaultMaxDiskUsage, "default-max-disk-usage", result.DefaultMaxDiskUsage, "max number of bytes of outputs of the default tenant, 0 for unlimited")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// remember flags set on the command line, they override the file and the environment
+	explicit := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	if *path != "" {
+		content, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read configuration file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(content, result); err != nil {
+			return nil, fmt.Errorf("Invalid configuration file %s: %v", *path, err)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		env := "PMMAP_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value := getenv(env); value != "" {
+			if seterr := f.Value.Set(value); seterr != nil {
+				err = fmt.Errorf("Invalid value %q for %s: %v", value, env, seterr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range explicit {
+		flags.Set(name, value)
+	}
+
+	return result, result.validate()
+}
+
+// validate checks the configuration, and creates the data directory
+func (config *Config) validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q is invalid: %v", config.ListenAddress, err))
+	}
+	if config.DataDir == "" {
+		problems = append(problems, "data directory can't be empty")
+	} else if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		problems = append(problems, fmt.Sprintf("data directory can't be created: %v", err))
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		problems = append(problems, "TLS certificate and key must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		problems = append(problems, "TLS client CA requires a TLS certificate and key")
+	}
+	for _, file := range []string{config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("TLS file can't be read: %v", err))
+		}
+	}
+	if config.JobTimeout <= 0 {
+		problems = append(problems, "job timeout must be positive")
+	}
+	if config.ShutdownGrace < 0 {
+		problems = append(problems, "shutdown grace period can't be negative")
+	}
+	if config.MaxRetries < 0 {
+		problems = append(problems, "max retries can't be negative")
+	}
+	if config.AttemptsRetention < 0 {
+		problems = append(problems, "attempts retention can't be negative")
+	}
+	if config.MaxJobs < 0 || config.MaxConcurrency < 0 || config.MaxInflight < 0 {
+		problems = append(problems, "max jobs, max concurrency and max inflight can't be negative")
+	}
+	if config.DefaultMaxJobs < 0 || config.DefaultMaxInflight < 0 || config.DefaultMaxQueued < 0 || config.DefaultMaxDiskUsage < 0 {
+		problems = append(problems, "quotas of the default tenant can't be negative")
+	}
+	if _, ok := logLevels[config.LogLevel]; !ok {
+		problems = append(problems, fmt.Sprintf("log level %q must be debug, info, warn or error", config.LogLevel))
+	}
+	if config.LogFormat != "logfmt" && config.LogFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log format %q must be logfmt or json", config.LogFormat))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration:\n - %s", strings.Join(problems, "\n - "))
+	}
+	return nil
+}
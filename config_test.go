@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadConfig tests that flags override the environment, which overrides the file
+func TestLoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pmmap")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pmmap.yml")
+	ioutil.WriteFile(path, []byte(`
+listen: ":9000"
+dataDir: `+filepath.Join(dir, "data")+`
+jobTimeout: 10s
+maxRetries: 2
+allowedWebhookHosts: ["*.example.com"]
+defaultMaxJobs: 2
+`), 0644)
+
+	env := map[string]string{"PMMAP_CONFIG": path, "PMMAP_MAX_RETRIES": "3", "PMMAP_LOG_LEVEL": "debug", "PMMAP_DEFAULT_MAX_INFLIGHT": "20"}
+	loaded, err := loadConfig([]string{"-log-level", "warn"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ListenAddress != ":9000" || loaded.JobTimeout != 10*time.Second {
+		t.Fatalf("file settings should be read: %+v", loaded)
+	}
+	if loaded.DefaultMaxJobs != 2 || loaded.DefaultMaxInflight != 20 {
+		t.Fatalf("quotas of the default tenant should be read: %d jobs, %d inflight", loaded.DefaultMaxJobs, loaded.DefaultMaxInflight)
+	}
+	if loaded.MaxRetries != 3 {
+		t.Fatalf("environment should override the file, max retries is %d", loaded.MaxRetries)
+	}
+	if loaded.LogLevel != "warn" {
+		t.Fatalf("flags should override the environment, log level is %s", loaded.LogLevel)
+	}
+	if !loaded.AllowedWebhookHosts.allows("api.example.com") || loaded.AllowedWebhookHosts.allows("example.org") {
+		t.Fatalf("allowed webhook hosts should be read: %v", loaded.AllowedWebhookHosts)
+	}
+}
+
+// TestValidateConfig tests that all problems are reported at once
+func TestValidateConfig(t *testing.T) {
+	noenv := func(string) string { return "" }
+	_, err := loadConfig([]string{"-listen", "nope", "-job-timeout", "0s", "-log-level", "loud", "-data-dir", os.TempDir()}, noenv)
+	if err == nil {
+		t.Fatal("invalid configuration should be rejected")
+	}
+	for _, problem := range []string{"listen address", "job timeout", "log level"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("error should mention the %s: %v", problem, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values allowed for a field of a cron expression
+type cronField map[int]bool
+
+// cronSchedule is a parsed cron expression: minute hour day-of-month month day-of-week
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	anyDOM, anyDOW                bool // day fields starting with *, as cron checks either day field when both are restricted
+}
+
+// cronShortcuts are the named cron expressions
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseCron parses a standard 5 fields cron expression, like "30 2 * * 1-5" or "*/15 * * * *",
+// or a shortcut like @daily. Day of week 0 and 7 are sunday
+func parseCron(expression string) (*cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[expression]; ok {
+		expression = shortcut
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression %q must have 5 fields", expression)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([]cronField, 5)
+	for index, field := range fields {
+		var err error
+		if parsed[index], err = parseCronField(field, bounds[index][0], bounds[index][1]); err != nil {
+			return nil, fmt.Errorf("Cron expression %q is invalid: %v", expression, err)
+		}
+	}
+	if parsed[4][7] {
+		parsed[4][0] = true
+	}
+	return &cronSchedule{
+		minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4],
+		anyDOM: strings.HasPrefix(fields[2], "*"), anyDOW: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges, with an optional /step
+func parseCronField(field string, min int, max int) (cronField, error) {
+	result := make(cronField)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.IndexByte(part, '/'); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:slash]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				high = max // like 5/15, from 5 to max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			result[value] = true
+		}
+	}
+	return result, nil
+}
+
+// matchesDay tells if a day matches the day of month and day of week fields: both of them,
+// unless both are restricted, like cron. Fields like */2 are wildcards with a step, not restrictions
+func (cron *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := cron.dom[t.Day()], cron.dow[int(t.Weekday())]
+	if cron.anyDOM || cron.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time matching the schedule strictly after t, to the minute.
+// Returns the zero time if there's none within 5 years, like for February 30th
+func (cron *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cron.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cron.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cron.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !cron.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
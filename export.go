@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// output export formats, chosen with the format query parameter or the Accept header
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv; charset=utf-8",
+}
+
+// export trailers, so clients can check they got everything
+const (
+	hashTrailer  = "PMMAP-content-sha256"
+	countTrailer = "PMMAP-outputs"
+)
+
+// defaultCSVFields are the CSV columns when the fields query parameter isn't set
+var defaultCSVFields = []string{"key", "value", "error.statusCode"}
+
+// outputJSON returns the API representation of an output
+func outputJSON(output *Output) kvJSON {
+	value, encoding := encodeValue(output.Value, output.ContentType)
+	return kvJSON{
+		Key:         output.Key,
+		Value:       value,
+		Encoding:    encoding,
+		ContentType: output.ContentType,
+		Error:       output.Error,
+		Metadata:    output.Metadata,
+	}
+}
+
+// outputDocument returns the API representation of an output as a decoded JSON document, for JSON paths.
+// Numbers are json.Number
+func outputDocument(output *Output) (interface{}, error) {
+	content, err := json.Marshal(outputJSON(output))
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err = decoder.Decode(&document)
+	return document, err
+}
+
+// exportFormat returns the format asked by a request: the format query parameter,
+// else the first supported type of the Accept header, else JSON
+func exportFormat(req *http.Request) (string, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", fmt.Errorf("Unknown format %s, use json, ndjson or csv", format)
+		}
+		return format, nil
+	}
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		switch mediaType(strings.TrimSpace(accepted)) {
+		case "application/json":
+			return formatJSON, nil
+		case "application/x-ndjson", "application/ndjson":
+			return formatNDJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// compressedFile is how a compressed export is downloaded as a file
+type compressedFile struct {
+	extension   string
+	contentType string
+}
+
+// compressions are the supported compressions of exports
+var compressions = map[string]compressedFile{
+	"gzip": {".gz", "application/gzip"},
+	"zstd": {".zst", "application/zstd"},
+}
+
+// exportCompression returns the compression asked by a request: the compress query parameter
+// for a compressed file, else zstd or gzip if the Accept-Encoding header allows it, else none.
+// Returns true when the compression is a Content-Encoding
+func exportCompression(req *http.Request) (string, bool, error) {
+	if compress := req.URL.Query().Get("compress"); compress != "" {
+		if _, ok := compressions[compress]; !ok {
+			return "", false, fmt.Errorf("Unsupported compression %s, use gzip or zstd", compress)
+		}
+		return compress, false, nil
+	}
+	result := ""
+	for _, accepted := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		switch encoding := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0]); encoding {
+		case "zstd":
+			return encoding, true, nil // smaller and faster, preferred
+		case "gzip":
+			result = encoding
+		}
+	}
+	return result, result != "", nil
+}
+
+// newCompressor returns a writer compressing to w
+func newCompressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	if compression == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// outputExporter writes outputs in an export format
+type outputExporter struct {
+	format string
+	fields []string // the CSV columns
+	out    io.Writer
+	csv    *csv.Writer
+	count  int
+}
+
+func newOutputExporter(format string, fields []string, out io.Writer) *outputExporter {
+	exporter := &outputExporter{format: format, fields: fields, out: out}
+	if format == formatCSV {
+		exporter.csv = csv.NewWriter(out)
+	}
+	return exporter
+}
+
+// start writes what comes before the first output
+func (exporter *outputExporter) start() error {
+	switch exporter.format {
+	case formatJSON:
+		_, err := io.WriteString(exporter.out, "[")
+		return err
+	case formatCSV:
+		return exporter.csv.Write(exporter.fields)
+	}
+	return nil
+}
+
+// write writes an output
+func (exporter *outputExporter) write(output *Output) error {
+	exporter.count++
+	line, err := json.Marshal(outputJSON(output))
+	if err != nil {
+		return err
+	}
+	switch exporter.format {
+	case formatJSON:
+		if exporter.count > 1 {
+			line = append([]byte(","), line...)
+		}
+	case formatNDJSON:
+		line = append(line, '\n')
+	case formatCSV:
+		record, err := csvRecord(line, exporter.fields)
+		if err != nil {
+			return err
+		}
+		return exporter.csv.Write(record)
+	}
+	_, err = exporter.out.Write(line)
+	return err
+}
+
+// end writes what comes after the last output
+func (exporter *outputExporter) end() error {
+	switch exporter.format {
+	case formatJSON:
+		_, err := io.WriteString(exporter.out, "]\n")
+		return err
+	case formatCSV:
+		exporter.csv.Flush()
+		return exporter.csv.Error()
+	}
+	return nil
+}
+
+// csvRecord flattens the fields of a JSON object, fields are dotted paths like value.user.name.
+// Strings are written as is, other values as JSON, missing values as empty strings
+func csvRecord(object []byte, fields []string) ([]string, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(object))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	record := make([]string, len(fields))
+	for index, field := range fields {
+		value := document
+		for _, name := range strings.Split(field, ".") {
+			switch typed := value.(type) {
+			case map[string]interface{}:
+				value = typed[name]
+			case []interface{}:
+				position, err := strconv.Atoi(name)
+				if err != nil || position < 0 || position >= len(typed) {
+					value = nil
+				} else {
+					value = typed[position]
+				}
+			default:
+				value = nil
+			}
+		}
+		switch typed := value.(type) {
+		case nil:
+		case string:
+			record[index] = typed
+		case json.Number:
+			record[index] = typed.String()
+		default:
+			text, _ := json.Marshal(typed)
+			record[index] = string(text)
+		}
+	}
+	return record, nil
+}
+
+// exportOutputs streams the outputs of a complete job in the format asked by the request.
+// The SHA-256 of the content and the number of outputs are sent as trailers
+func exportOutputs(w http.ResponseWriter, req *http.Request, job *Job) {
+	format, err := exportFormat(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	compression, contentEncoding, err := exportCompression(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	fields := defaultCSVFields
+	if list := req.URL.Query().Get("fields"); list != "" {
+		fields = strings.Split(list, ",")
+	}
+
+	filename := job.ID + "." + format
+	w.Header().Set("Content-Type", formatTypes[format])
+	if compression != "" {
+		if contentEncoding {
+			w.Header().Set("Content-Encoding", compression)
+			w.Header().Add("Vary", "Accept-Encoding")
+		} else {
+			w.Header().Set("Content-Type", compressions[compression].contentType)
+			filename += compressions[compression].extension
+		}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Trailer", hashTrailer+", "+countTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	// the hash is the one of the file clients get: decoded with a Content-Encoding, compressed otherwise
+	var digest hash.Hash = sha256.New()
+	var out io.Writer = io.MultiWriter(w, digest)
+	var compressor io.WriteCloser
+	if compression != "" && contentEncoding {
+		compressor, err = newCompressor(compression, w)
+		out = io.MultiWriter(compressor, digest)
+	} else if compression != "" {
+		compressor, err = newCompressor(compression, out)
+		out = compressor
+	}
+	exporter := newOutputExporter(format, fields, out)
+	if err == nil {
+		err = exporter.start()
+	}
+	if err == nil {
+		err = job.EachOutput(exporter.write)
+	}
+	if err == nil {
+		err = exporter.end()
+	}
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		// the status is sent already, missing trailers tell the export is incomplete
+		job.log(levelError, "can't export outputs", "format", format, "error", err)
+		return
+	}
+	w.Header().Set(hashTrailer, hex.EncodeToString(digest.Sum(nil)))
+	w.Header().Set(countTrailer, strconv.Itoa(exporter.count))
+}
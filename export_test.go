@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCSVRecord(t *testing.T) {
+	record, err := csvRecord([]byte(`{"key":"k","value":{"user":{"name":"bob","age":42},"tags":["a","b"]}}`),
+		[]string{"key", "value.user.name", "value.user.age", "value.tags", "value.tags.1", "value.missing", "error.statusCode"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"k", "bob", "42", `["a","b"]`, "b", "", ""}
+	for index := range expected {
+		if record[index] != expected[index] {
+			t.Fatalf("CSV record should be %v, not %v", expected, record)
+		}
+	}
+}
+
+// TestExports gets the outputs of a job in every format
+func TestExports(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"` + strings.TrimPrefix(req.URL.Path, "/") + `"}`))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Start(1)
+	job.AddToJob("a", []byte(`1`))
+	job.AddToJob("b", []byte(`2`))
+	job.AllInputsWereSent()
+	<-job.Complete
+	Manager.addJob(job)
+	jobURL := "http://localhost:8080/job/" + job.ID + "/output"
+
+	for _, test := range []struct {
+		query, accept, contentType, expected string
+	}{
+		{"", "", "application/json", `[{"key":"a","value":{"name":"a"},"contentType":"application/json"},{"key":"b","value":{"name":"b"},"contentType":"application/json"}]` + "\n"},
+		{"", "application/x-ndjson", "application/x-ndjson", `{"key":"a","value":{"name":"a"},"contentType":"application/json"}` + "\n" + `{"key":"b","value":{"name":"b"},"contentType":"application/json"}` + "\n"},
+		{"?format=csv&fields=key,value.name", "", "text/csv; charset=utf-8", "key,value.name\na,a\nb,b\n"},
+	} {
+		req, _ := http.NewRequest("GET", jobURL+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.Header.Get("Content-Type") != test.contentType || string(body) != test.expected {
+			t.Fatalf("export %s %s isn't right: %s %q", test.query, test.accept, res.Header.Get("Content-Type"), body)
+		}
+		hash := sha256.Sum256(body)
+		if res.Trailer.Get(hashTrailer) != hex.EncodeToString(hash[:]) || res.Trailer.Get(countTrailer) != "2" {
+			t.Fatalf("trailers should check the content: %v", res.Trailer)
+		}
+	}
+
+	res, err := http.Get(jobURL + "?format=ndjson&compress=gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") != "application/gzip" || !strings.Contains(res.Header.Get("Content-Disposition"), job.ID+".ndjson.gz") {
+		t.Fatalf("compressed exports should be downloaded as files: %v", res.Header)
+	}
+	hash := sha256.Sum256(archive)
+	if res.Trailer.Get(hashTrailer) != hex.EncodeToString(hash[:]) {
+		t.Fatal("the hash of compressed exports should be the hash of the file")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(reader)
+	if strings.Count(string(content), "\n") != 2 {
+		t.Fatalf("compressed NDJSON should have 2 lines: %q", content)
+	}
+
+	res, err = http.Get(jobURL + "?format=ndjson&compress=zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ = ioutil.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") != "application/zstd" || !strings.Contains(res.Header.Get("Content-Disposition"), job.ID+".ndjson.zst") {
+		t.Fatalf("zstd exports should be downloaded as files: %v", res.Header)
+	}
+	decoder, _ := zstd.NewReader(nil)
+	defer decoder.Close()
+	if content, err = decoder.DecodeAll(archive, nil); err != nil || strings.Count(string(content), "\n") != 2 {
+		t.Fatalf("zstd NDJSON should have 2 lines: %q (%v)", content, err)
+	}
+
+	req, _ := http.NewRequest("GET", jobURL+"?format=ndjson", nil)
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ = ioutil.ReadAll(res.Body)
+	hash = sha256.Sum256(content)
+	if res.Header.Get("Content-Encoding") != "zstd" || res.Trailer.Get(hashTrailer) != hex.EncodeToString(hash[:]) {
+		t.Fatalf("zstd should be negotiated with Accept-Encoding: %v", res.Header)
+	}
+	if decoded, err := decoder.DecodeAll(archive, nil); err != nil || string(decoded) != string(content) {
+		t.Fatalf("zstd encoded exports should decode to the export: %q (%v)", decoded, err)
+	}
+}
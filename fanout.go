@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// envelopeContentType is the content type of webhook replies carrying child inputs
+const envelopeContentType = "application/vnd.pmmap.envelope+json"
+
+// seenPrefix is the storage prefix of the keys already added to a job with fan-out
+const seenPrefix = "seen\x00"
+
+// fanOutJSON lets webhook replies add inputs to their own job
+type fanOutJSON struct {
+	MaxInputs int64 `json:"maxInputs"` // max number of inputs spawned by the webhook, 0 for no limit
+}
+
+// envelopeJSON is a webhook reply with child inputs, output is the output of the input
+type envelopeJSON struct {
+	Output json.RawMessage `json:"output"`
+	Inputs []inputJSON     `json:"inputs"`
+}
+
+// fanOutStatus counts the inputs spawned by the webhook
+type fanOutStatus struct {
+	Spawned int64 `json:"spawned"`
+	Dropped int64 `json:"dropped"` // beyond maxInputs, or over the queued inputs quota
+}
+
+// fanOut dedupes the inputs of a job, and counts the inputs spawned by the webhook
+type fanOut struct {
+	sync.Mutex // serializes dedupe checks
+	maxInputs  int64
+	status     fanOutStatus
+}
+
+func newFanOut(options *fanOutJSON) (*fanOut, error) {
+	if options.MaxInputs < 0 {
+		return nil, fmt.Errorf("Fan-out maxInputs can't be negative")
+	}
+	return &fanOut{maxInputs: options.MaxInputs}, nil
+}
+
+func (fan *fanOut) getStatus() fanOutStatus {
+	fan.Lock()
+	defer fan.Unlock()
+	return fan.status
+}
+
+// seenKey returns the storage key recording that a key was added to the job
+func seenKey(key string) []byte {
+	return []byte(seenPrefix + key)
+}
+
+// markInputsSeen records the keys of inputs sent by a client, so the webhook can't spawn them again
+func (job *Job) markInputsSeen(inputs []Input) {
+	job.fanOut.Lock()
+	defer job.fanOut.Unlock()
+	for _, input := range inputs {
+		if err := job.store(seenKey(input.Key), nil); err != nil {
+			job.log(levelWarn, "can't record input key", "key", input.Key, "error", err)
+		}
+	}
+}
+
+// openEnvelope reads a webhook reply with child inputs, queues the inputs whose key wasn't
+// seen yet and returns the output. Inputs are queued before the parent gets its output,
+// so the job can't complete until they all got theirs
+func (job *Job) openEnvelope(parent string, body []byte) ([]byte, error) {
+	var envelope envelopeJSON
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("Invalid envelope: %v", err)
+	}
+	inputs := make([]Input, 0, len(envelope.Inputs))
+	for _, each := range envelope.Inputs {
+		value, err := decodeValue(each.Value, each.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s in envelope: %v", each.Key, err)
+		}
+		inputs = append(inputs, Input{Key: each.Key, Value: value, Priority: each.Priority})
+	}
+
+	fan := job.fanOut
+	fan.Lock()
+	defer fan.Unlock()
+	for _, input := range inputs {
+		if seen, err := job.outputsDB.Has(seenKey(input.Key), nil); err != nil {
+			return nil, err
+		} else if seen {
+			continue
+		}
+		if fan.maxInputs > 0 && fan.status.Spawned >= fan.maxInputs {
+			fan.status.Dropped++
+			job.log(levelWarn, "spawned input dropped, too many inputs", "key", input.Key, "parent", parent)
+			continue
+		}
+		if err := job.tenant.queueInputs(1); err != nil {
+			fan.status.Dropped++
+			job.log(levelWarn, "spawned input dropped", "key", input.Key, "parent", parent, "error", err)
+			continue
+		}
+		if err := job.store(seenKey(input.Key), nil); err != nil {
+			job.tenant.inputsDequeued(1)
+			return nil, err
+		}
+		fan.status.Spawned++
+		atomic.AddInt64(&job.pending, 1)
+		atomic.AddInt64(&job.inputsCount, 1)
+		job.queue.push(input, true, nil)
+	}
+
+	if len(envelope.Output) == 0 || string(envelope.Output) == "null" {
+		return nil, nil
+	}
+	return envelope.Output, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCrawlJob crawls a tree of pages from "root", each page links to 2 children down to depth 3,
+// and back to the root
+func runCrawlJob(t *testing.T, options fanOutJSON) *Job {
+	crawler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := path.Base(req.URL.Path)
+		inputs := []inputJSON{{Key: "root", Value: json.RawMessage(`null`)}}
+		if strings.Count(page, ".") < 2 {
+			inputs = append(inputs, inputJSON{Key: page + ".a", Value: json.RawMessage(`null`)}, inputJSON{Key: page + ".b", Value: json.RawMessage(`null`)})
+		}
+		w.Header().Set("Content-Type", envelopeContentType)
+		json.NewEncoder(w).Encode(map[string]interface{}{"output": map[string]int{"links": len(inputs)}, "inputs": inputs})
+	}))
+	defer crawler.Close()
+
+	u, _ := url.Parse(crawler.URL + "/{key}")
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.request, _ = newWebhookRequest("POST", crawler.URL+"/{key}", nil, nil)
+	if job.fanOut, err = newFanOut(&options); err != nil {
+		t.Fatal(err)
+	}
+	job.Start(2)
+	job.AddToJob("root", nil)
+	job.AllInputsWereSent() // before the children are spawned
+	select {
+	case <-job.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete")
+	}
+	return job
+}
+
+func TestFanOut(t *testing.T) {
+	job := runCrawlJob(t, fanOutJSON{})
+	if job.GetInputsCount() != 7 || job.GetOutputsCount() != 7 {
+		t.Fatalf("the 7 pages should be crawled once, not %d times", job.GetOutputsCount())
+	}
+	output, err := job.GetOutput("root.a.b")
+	if err != nil || output == nil || string(output.Value) != `{"links":1}` || output.ContentType != "application/json" {
+		t.Fatalf("outputs should be the output of envelopes: %+v (%v)", output, err)
+	}
+	if status := job.fanOut.getStatus(); status.Spawned != 6 || status.Dropped != 0 {
+		t.Fatalf("6 inputs should be spawned: %+v", status)
+	}
+
+	job = runCrawlJob(t, fanOutJSON{MaxInputs: 2})
+	if job.GetOutputsCount() != 3 {
+		t.Fatalf("only 2 inputs should be spawned, not %d", job.GetOutputsCount()-1)
+	}
+	if status := job.fanOut.getStatus(); status.Spawned != 2 || status.Dropped != 4 {
+		t.Fatalf("the children of root.a and root.b should be dropped: %+v", status)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// healthz tells the process is alive
+func healthz(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyz tells whether PMmap can accept new jobs
+func readyz(w http.ResponseWriter, req *http.Request) {
+	var problems []string
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		problems = append(problems, "shutting down")
+	}
+	if config.MaxJobs > 0 && Manager.count() >= config.MaxJobs {
+		problems = append(problems, fmt.Sprintf("max number of jobs (%d) reached", config.MaxJobs))
+	}
+	if file, err := ioutil.TempFile(config.DataDir, ".readyz"); err != nil {
+		problems = append(problems, fmt.Sprintf("data directory is not writable: %v", err))
+	} else {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready    bool     `json:"ready"`
+		Problems []string `json:"problems,omitempty"`
+	}{len(problems) == 0, problems})
+}
+
+// debugStatus summarises the state of the server, to spot leaks
+func debugStatus(w http.ResponseWriter, req *http.Request) {
+	jobs := Manager.snapshot()
+	states := make(map[string]int)
+	queued := 0
+	for _, job := range jobs {
+		states[stateNames[atomic.LoadInt64(&job.State)]]++
+		queued += job.queue.len()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Jobs          int            `json:"jobs"`
+		JobsPerState  map[string]int `json:"jobsPerState"`
+		Goroutines    int            `json:"goroutines"`
+		QueuedInputs  int            `json:"queuedInputs"`
+		OpenDatabases int64          `json:"openDatabases"`
+		Inflight      int64          `json:"inflight"`
+	}{
+		len(jobs),
+		states,
+		runtime.NumGoroutine(),
+		queued,
+		atomic.LoadInt64(&openDatabases),
+		Scheduler.count(),
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz", "/debug/status"} {
+		res, err := http.Get("http://localhost:8080" + path)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s should reply with 200 %v", path, err)
+		}
+	}
+
+	res, _ := http.Get("http://localhost:8080/debug/status")
+	var status map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&status)
+	if status["goroutines"].(float64) == 0 {
+		t.Fatal("status should count goroutines")
+	}
+	if _, ok := status["openDatabases"]; !ok {
+		t.Fatal("status should count open databases")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultKeyColumn is the CSV column holding the keys of inputs by default
+const defaultKeyColumn = "key"
+
+// ingestJSON is the source of inputs sent to POST /job/{id}/input/from
+type ingestJSON struct {
+	URL       string            `json:"url"`       // http or https source
+	Headers   map[string]string `json:"headers"`   // sent to the source URL
+	Path      string            `json:"path"`      // file source, relative to the input directory of the server
+	Format    string            `json:"format"`    // ndjson, csv or json, guessed from the extension or content type by default
+	KeyColumn string            `json:"keyColumn"` // the CSV column of keys, "key" by default
+	Complete  bool              `json:"complete"`  // true to tell the job all inputs were sent once the source is read
+}
+
+// ingestionStatus is the progress of an ingestion, apart from the processing of its inputs
+type ingestionStatus struct {
+	Source   string     `json:"source"`
+	State    string     `json:"state"` // running, done or failed
+	Inputs   int64      `json:"inputs"`
+	Bytes    int64      `json:"bytes"`          // read from the source, compressed if it's gzipped
+	Size     int64      `json:"size,omitempty"` // of the source, when it's known
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// ingestion streams a source into a job. Inputs are added one by one,
+// so reading waits while the queue of the job is full
+type ingestion struct {
+	sync.Mutex
+	spec   ingestJSON
+	status ingestionStatus
+	inputs int64 // counts inputs added to the job
+	bytes  int64 // counts bytes read from the source
+}
+
+// newIngestion checks a source, guessing its format from its name when it's not set
+func newIngestion(spec ingestJSON) (*ingestion, error) {
+	source := spec.URL
+	switch {
+	case spec.URL != "" && spec.Path != "":
+		return nil, fmt.Errorf("Source must have either a url or a path")
+	case spec.URL != "":
+		if err := checkSourceURL(spec.URL); err != nil {
+			return nil, err
+		}
+	case spec.Path != "":
+		if config.InputDir == "" {
+			return nil, fmt.Errorf("File sources are disabled on this server")
+		}
+		source = spec.Path
+	default:
+		return nil, fmt.Errorf("Source must have a url or a path")
+	}
+	if spec.Format == "" {
+		spec.Format = formatFromName(source)
+	}
+	if spec.Format != "" && spec.Format != formatNDJSON && spec.Format != formatCSV && spec.Format != formatJSON {
+		return nil, fmt.Errorf("Unknown source format %s", spec.Format)
+	}
+	if spec.KeyColumn == "" {
+		spec.KeyColumn = defaultKeyColumn
+	}
+	return &ingestion{spec: spec, status: ingestionStatus{Source: source, State: "running", Started: time.Now().UTC()}}, nil
+}
+
+// formatFromName guesses a format from the extension of a path or URL, empty if unknown
+func formatFromName(name string) string {
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+	switch path.Ext(name) {
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".csv":
+		return formatCSV
+	case ".json":
+		return formatJSON
+	}
+	return ""
+}
+
+// formatFromContentType guesses a format from the content type of a source, ndjson by default
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "application/json":
+		return formatJSON
+	}
+	return formatNDJSON
+}
+
+// inputPath returns the path of a file source, it can't be out of the input directory
+func inputPath(path string) string {
+	return filepath.Join(config.InputDir, filepath.Clean("/"+path))
+}
+
+// getStatus returns a copy of the ingestion status
+func (ingest *ingestion) getStatus() ingestionStatus {
+	ingest.Lock()
+	defer ingest.Unlock()
+	status := ingest.status
+	status.Inputs = atomic.LoadInt64(&ingest.inputs)
+	status.Bytes = atomic.LoadInt64(&ingest.bytes)
+	return status
+}
+
+func (ingest *ingestion) running() bool {
+	ingest.Lock()
+	defer ingest.Unlock()
+	return ingest.status.State == "running"
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	atomic.AddInt64(counter.count, int64(n))
+	return n, err
+}
+
+// startIngestion streams a source into a job in the background.
+// Only one ingestion may run at a time in a job
+func (job *Job) startIngestion(ingest *ingestion) error {
+	job.Lock()
+	defer job.Unlock()
+	if job.ingestion != nil && job.ingestion.running() {
+		return fmt.Errorf("An ingestion is already running in this job")
+	}
+	job.ingestion = ingest
+	go job.ingest(ingest)
+	return nil
+}
+
+// getIngestion returns the last ingestion of the job, nil if there's none
+func (job *Job) getIngestion() *ingestion {
+	job.Lock()
+	defer job.Unlock()
+	return job.ingestion
+}
+
+// ingest reads the source of an ingestion, and records how it ended
+func (job *Job) ingest(ingest *ingestion) {
+	job.log(levelInfo, "ingestion started", "source", ingest.status.Source)
+	err := job.readSource(ingest)
+	if err == nil && ingest.spec.Complete {
+		err = job.AllInputsWereSent()
+	}
+	ingest.Lock()
+	finished := time.Now().UTC()
+	ingest.status.Finished = &finished
+	if err != nil {
+		ingest.status.State = "failed"
+		ingest.status.Error = err.Error()
+	} else {
+		ingest.status.State = "done"
+	}
+	ingest.Unlock()
+	inputs := atomic.LoadInt64(&ingest.inputs)
+	if err != nil {
+		job.log(levelWarn, "ingestion failed", "source", ingest.status.Source, "inputs", inputs, "error", err)
+		return
+	}
+	job.log(levelInfo, "ingestion done", "source", ingest.status.Source, "inputs", inputs)
+}
+
+// readSource opens the source, decompresses it if it's gzipped, and adds its inputs to the job
+func (job *Job) readSource(ingest *ingestion) error {
+	var source io.ReadCloser
+	var size int64
+	format := ingest.spec.Format
+	if ingest.spec.URL != "" {
+		res, err := fetchSource(ingest.spec.URL, ingest.spec.Headers)
+		if err != nil {
+			return err
+		}
+		if format == "" {
+			format = formatFromContentType(res.Header.Get("Content-Type"))
+		}
+		source, size = res.Body, res.ContentLength
+	} else {
+		file, err := os.Open(inputPath(ingest.spec.Path))
+		if err != nil {
+			return fmt.Errorf("Can't open source %s", ingest.spec.Path)
+		}
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+		source = file
+	}
+	defer source.Close()
+	if format == "" {
+		format = formatNDJSON
+	}
+	if size > 0 {
+		ingest.Lock()
+		ingest.status.Size = size
+		ingest.Unlock()
+	}
+
+	// gzipped sources are recognized by their magic number, whatever their name
+	buffered := bufio.NewReader(&countingReader{source, &ingest.bytes})
+	var reader io.Reader = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("Invalid gzipped source: %v", err)
+		}
+		defer unzipped.Close()
+		reader = unzipped
+	}
+
+	add := func(each *inputJSON) error {
+		if err := addInputJSON(job, each); err != nil {
+			return err
+		}
+		atomic.AddInt64(&ingest.inputs, 1)
+		return nil
+	}
+	switch format {
+	case formatCSV:
+		return readCSV(reader, ingest.spec.KeyColumn, add)
+	case formatJSON:
+		return readJSONArray(reader, add)
+	}
+	return readNDJSON(reader, add)
+}
+
+// readCSV reads inputs from a CSV file with a header row. The value of each input
+// is a JSON object of the other columns of its row, as strings
+func readCSV(reader io.Reader, keyColumn string, fn func(*inputJSON) error) error {
+	rows := csv.NewReader(reader)
+	header, err := rows.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid CSV header: %v", err)
+	}
+	keyIndex := -1
+	for index, name := range header {
+		if name == keyColumn {
+			keyIndex = index
+		}
+	}
+	if keyIndex < 0 {
+		return fmt.Errorf("CSV has no %s column", keyColumn)
+	}
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid CSV: %v", err)
+		}
+		value := make(map[string]string, len(row)-1)
+		for index, cell := range row {
+			if index != keyIndex {
+				value[header[index]] = cell
+			}
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(&inputJSON{Key: row[keyIndex], Value: encoded}); err != nil {
+			return err
+		}
+	}
+}
+
+// readJSONArray reads inputs from a JSON array, one element at a time
+func readJSONArray(reader io.Reader, fn func(*inputJSON) error) error {
+	decoder := json.NewDecoder(reader)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return fmt.Errorf("Source must be a JSON array of inputs")
+	}
+	for index := 0; decoder.More(); index++ {
+		var each inputJSON
+		if err := decoder.Decode(&each); err != nil {
+			return fmt.Errorf("Invalid input at index %d: %v", index, err)
+		}
+		if err := fn(&each); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("Invalid end of the JSON array: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ingestInto creates a job, streams a source into it and waits until it completes
+func ingestInto(t *testing.T, source string) (*Job, ingestionStatus) {
+	query := `{"secret":"` + Secret + `","url":"http://localhost:7777/test","maxsize":2,"concurrency":1}`
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(query)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+
+	res, err = http.Post("http://localhost:8080/job/"+job.ID+"/input/from", "application/json", bytes.NewReader([]byte(source)))
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("ingestion should start (%v)", err)
+	}
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete once the source is read")
+	}
+	res, _ = http.Get("http://localhost:8080/job/" + job.ID + "/input/from")
+	var status ingestionStatus
+	json.NewDecoder(res.Body).Decode(&status)
+	return job, status
+}
+
+func TestIngestURL(t *testing.T) {
+	var lines bytes.Buffer
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		lines.WriteString(`{"key":"` + key + `","value":1}` + "\n")
+	}
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write(lines.Bytes())
+	writer.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/inputs.json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"key":"x","value":1},{"key":"y","value":"two"}]`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(gzipped.Bytes())
+	}))
+	defer source.Close()
+
+	job, status := ingestInto(t, `{"url":"`+source.URL+`/inputs","complete":true}`)
+	defer Manager.delJob(job.ID)
+	if job.GetOutputsCount() != 5 || status.State != "done" || status.Inputs != 5 || status.Bytes != int64(gzipped.Len()) {
+		t.Fatalf("the gzipped NDJSON source should be sent: %d outputs, %+v", job.GetOutputsCount(), status)
+	}
+
+	job, status = ingestInto(t, `{"url":"`+source.URL+`/inputs.json","complete":true}`)
+	defer Manager.delJob(job.ID)
+	if job.GetOutputsCount() != 2 || status.State != "done" || status.Inputs != 2 {
+		t.Fatalf("the JSON array source should be sent: %d outputs, %+v", job.GetOutputsCount(), status)
+	}
+}
+
+func TestIngestFile(t *testing.T) {
+	if _, err := newIngestion(ingestJSON{Path: "inputs.csv"}); err == nil {
+		t.Fatal("file sources should be disabled without input directory")
+	}
+	dir, _ := ioutil.TempDir("", "input")
+	defer os.RemoveAll(dir)
+	defer func() { config.InputDir = "" }()
+	config.InputDir = dir
+	ioutil.WriteFile(filepath.Join(dir, "inputs.csv"), []byte("id,name\n1,one\n2,two\n3,three\n"), 0644)
+
+	if inputPath("../../inputs.csv") != filepath.Join(dir, "inputs.csv") {
+		t.Fatal("file sources can't be out of the input directory")
+	}
+	job, status := ingestInto(t, `{"path":"../inputs.csv","keyColumn":"id","complete":true}`)
+	defer Manager.delJob(job.ID)
+	if job.GetOutputsCount() != 3 || status.State != "done" || status.Inputs != 3 || status.Size != status.Bytes {
+		t.Fatalf("the CSV source should be sent: %d outputs, %+v", job.GetOutputsCount(), status)
+	}
+	output, _ := job.GetOutput("2")
+	if output == nil {
+		t.Fatal("CSV rows should be sent with the key of their id column")
+	}
+}
+
+// TestIngestBackpressure tests that the job can be read while the ingestion waits for room in its queue
+func TestIngestBackpressure(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`1`))
+	}))
+	defer backend.Close()
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{\"key\":\"a\"}\n{\"key\":\"b\"}\n{\"key\":\"c\"}\n{\"key\":\"d\"}\n"))
+	}))
+	defer source.Close()
+
+	query := `{"secret":"` + Secret + `","url":"` + backend.URL + `","maxsize":1,"concurrency":1}`
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(query)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	defer Manager.delJob(job.ID)
+	defer job.Stop(context.Background())
+
+	http.Post("http://localhost:8080/job/"+job.ID+"/input/from", "application/json", bytes.NewReader([]byte(`{"url":"`+source.URL+`"}`)))
+	time.Sleep(50 * time.Millisecond) // the queue is full, the ingestion waits
+	start := time.Now()
+	res, err = http.Get("http://localhost:8080/job/" + job.ID)
+	if err != nil || res.StatusCode != http.StatusOK || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("the job should be read at once while the ingestion waits, not after %v (%v)", time.Since(start), err)
+	}
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/chrisDeFouRire/pmmap/signature"
 	"github.com/satori/go.uuid"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-var dbPath = "./db/"
+// storage key prefixes, to store outputs and attempts in the same database
+const (
+	outputPrefix  = "output\x00"
+	attemptPrefix = "attempt\x00"
+)
+
+// openDatabases counts the outputs storages currently open
+var openDatabases int64
 
 // OutputError is set on Output when an unrecuperable error has occurred
 type OutputError struct {
@@ -29,96 +39,285 @@ type OutputError struct {
 type Input struct {
 	Key        string
 	Value      []byte // TODO use interface{} instead?
+	Priority   int    // inputs with a higher priority are sent first
 	retryCount int
 }
 
+// OutputMetadata describes the backend reply of an output, stored when the job asks for it
+type OutputMetadata struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers,omitempty"` // the response headers selected by the job
+	Latency    int64             `json:"latency"`           // in milliseconds
+}
+
 // Output encapsulates the output of jobs
 type Output struct {
-	Key   string
-	Value []byte // TODO use interface{} instead?
-	Error *OutputError
+	Key         string
+	Value       []byte // TODO use interface{} instead?
+	ContentType string // the content type of the value, as sent by the backend
+	Error       *OutputError
+	Metadata    *OutputMetadata
 }
 
 // Job encapsulate a single instance of a job
 type Job struct {
 	sync.Mutex
-	ID           string          // the job ID
-	Complete     chan bool       // true is sent upon completion
-	secretKey    string          // the job secret key (sent to webhooks)
-	workURL      url.URL         // the URL radix we send work to
-	inChan       chan Input      // channel where input is sent
-	outChan      chan Output     // channel where output is sent
-	wg           *sync.WaitGroup // to synchronize workers
-	inputsCount  int64           // counts inputs received
-	outputsCount int64           // counts outputs received
-	State        int64           // the state of the job
-	outputsDB    *leveldb.DB     // the storage for outputs
+	ID                string          // the job ID
+	Complete          chan bool       // true is sent upon completion
+	secretKey         string          // the job secret key (signs webhook requests)
+	plaintext         bool            // true to also send the secret key in the PMMAP-auth header
+	request           *webhookRequest // how inputs are sent to the webhook
+	client            *http.Client    // the client calling the webhook
+	queue             *inputQueue     // where inputs wait for a worker
+	outChan           chan Output     // channel where output is sent
+	wg                *sync.WaitGroup // to synchronize workers
+	maxRetries        int             // max number of retries of an input
+	successCodes      []int           // the webhook status codes of outputs, others are retried or fail
+	metadata          bool            // true to store the metadata of each output
+	keepHeaders       []string        // the response headers stored in the metadata
+	attemptsRetention int             // max number of attempts recorded per key
+	inputsCount       int64           // counts inputs received
+	pending           int64           // counts inputs received which didn't get an output yet
+	outputsCount      int64           // counts outputs received
+	State             int64           // the state of the job
+	outputsDB         *leveldb.DB     // the storage for outputs
+	tenant            *Tenant         // the tenant owning the job
+	diskUsage         int64           // counts bytes of outputs stored
+	quit              chan struct{}   // closed to stop the workers
+	stopOnce          sync.Once       // to close quit only once
+	closeOnce         sync.Once       // to close the outputs storage only once
+	done              chan struct{}   // closed when all outputs are stored
+	failure           atomic.Value    // the error which moved the job to ErrorState
+	sink              *outputSink     // where outputs are pushed when the job completes, may be nil
+	reducer           *reducer        // reduces outputs when the job completes, may be nil
+	aggregates        *aggregates     // built-in aggregates computed as outputs are received, may be nil
+	fanOut            *fanOut         // lets webhook replies spawn inputs, may be nil
+	async             *asyncCalls     // inputs waiting for their callback, nil unless the webhook replies later
+	leases            *leases         // inputs leased by workers, nil unless it's a pull job
+	ingestion         *ingestion      // the last source streamed with POST /job/{id}/input/from, may be nil
+	batchSize         int             // max number of inputs sent in a single webhook call, inputs are sent one by one below 2
+	batchWait         time.Duration   // how long a worker waits to fill a batch
+	weight            int64           // share of webhook call slots, against other jobs of the tenant
+	inflight          int64           // counts webhook calls in flight
+	onOutput          func(Output)    // called with each output once stored, may be nil
+	onComplete        func()          // called once all outputs are stored, may be nil
 }
 
 // MarshalJSON gives a JSON representation of a Job
 func (job *Job) MarshalJSON() ([]byte, error) {
 	job.Lock()
 	defer job.Unlock()
+	failure, _ := job.failure.Load().(string)
+	var reduceState *reduceStatus
+	if job.reducer != nil {
+		status := job.reducer.getStatus()
+		reduceState = &status
+	}
+	var fanOutState *fanOutStatus
+	if job.fanOut != nil {
+		status := job.fanOut.getStatus()
+		fanOutState = &status
+	}
+	var asyncState *asyncStatus
+	if job.async != nil {
+		asyncState = &asyncStatus{Waiting: job.async.count()}
+	}
+	var pullState *pullStatus
+	if job.leases != nil {
+		pullState = &pullStatus{Leased: job.leases.count()}
+	}
+	var ingestionState *ingestionStatus
+	if job.ingestion != nil {
+		status := job.ingestion.getStatus()
+		ingestionState = &status
+	}
+	var sinkState *sinkStatus
+	if job.sink != nil {
+		status := job.sink.getStatus()
+		sinkState = &status
+	}
 	return json.Marshal(&struct {
-		ID           string `json:"id"`
-		InputsCount  int    `json:"inputs"`
-		OutputsCount int    `json:"outputs"`
-		URL          string `json:"url"`
+		ID           string           `json:"id"`
+		InputsCount  int              `json:"inputs"`
+		OutputsCount int              `json:"outputs"`
+		Inflight     int64            `json:"inflight"`
+		Weight       int64            `json:"weight"`
+		URL          string           `json:"url"`
+		Tenant       string           `json:"tenant"`
+		State        string           `json:"state"`
+		Error        string           `json:"error,omitempty"`
+		FanOut       *fanOutStatus    `json:"fanOut,omitempty"`
+		Async        *asyncStatus     `json:"async,omitempty"`
+		Pull         *pullStatus      `json:"pull,omitempty"`
+		Ingestion    *ingestionStatus `json:"ingestion,omitempty"`
+		Sink         *sinkStatus      `json:"sink,omitempty"`
+		Reduce       *reduceStatus    `json:"reduce,omitempty"`
 	}{
 		job.ID,
 		int(job.GetInputsCount()),
 		int(job.GetOutputsCount()),
-		job.workURL.String()})
+		atomic.LoadInt64(&job.inflight),
+		job.weight,
+		job.request.raw,
+		job.tenant.ID,
+		stateNames[atomic.LoadInt64(&job.State)],
+		failure,
+		fanOutState,
+		asyncState,
+		pullState,
+		ingestionState,
+		sinkState,
+		reduceState})
+}
+
+// JobFailedError is returned when a job failed because of a server side problem
+type JobFailedError struct {
+	JobID string
+	Err   error
+}
+
+func (err *JobFailedError) Error() string {
+	return fmt.Sprintf("Job %s failed: %v", err.JobID, err.Err)
 }
 
-// CreateJob creates a new Job, ready to start
-// returns a job
-// TODO add backend timeout
-func CreateJob(secret string, u url.URL, maxsize uint) *Job {
+// CreateJob creates a new Job for a tenant, ready to start
+// inputs are POSTed to the URL, with their key as last path segment
+// returns a job, or an error if the tenant can't run another job
+func CreateJob(tenant *Tenant, secret string, u url.URL, maxsize uint) (*Job, error) {
+	request := &webhookRequest{} // pull jobs have no URL
+	if u.String() != "" {
+		var err error
+		if request, err = newWebhookRequest("POST", u.String(), nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := tenant.startJob(); err != nil {
+		return nil, err
+	}
 	_id := uuid.NewV4().String()
 
 	// create the job instance
 	job := &Job{
 		ID:        _id,
 		secretKey: secret,
-		workURL:   u,
-		inChan:    make(chan Input, maxsize),
-		outChan:   make(chan Output),
-		wg:        &sync.WaitGroup{},
-		Complete:  make(chan bool, 1),
-		State:     Created,
-		outputsDB: nil,
+		request:   request,
+		client: &http.Client{
+			Timeout: config.JobTimeout,
+		},
+		maxRetries:        config.MaxRetries,
+		successCodes:      []int{http.StatusOK},
+		weight:            1,
+		attemptsRetention: config.AttemptsRetention,
+		queue:             newInputQueue(int(maxsize)),
+		outChan:           make(chan Output),
+		wg:                &sync.WaitGroup{},
+		Complete:          make(chan bool, 1),
+		State:             Created,
+		outputsDB:         nil,
+		tenant:            tenant,
+		quit:              make(chan struct{}),
+		done:              make(chan struct{}),
 	}
-	return job
+	return job, nil
 }
 
 // Start working goroutines
-func (job *Job) Start(concurrency int) {
-	// wait until all workers are done
-	go job.startCompletionWaiter()
+// returns an error if the outputs storage can't be opened
+func (job *Job) Start(concurrency int) error {
+	var err error
+	job.outputsDB, err = leveldb.OpenFile(filepath.Join(config.DataDir, "job", job.ID), nil)
+	if err != nil {
+		job.tenant.jobFinished()
+		return job.fail(err)
+	}
+	atomic.AddInt64(&openDatabases, 1)
 
 	// start Output receiver
 	go job.startOutputLogger()
 
-	// start all workers
-	job.startWorkers(concurrency)
+	// start all workers, or wait for workers to lease inputs
+	if job.leases != nil {
+		job.wg.Add(1)
+		go job.startLeaseReaper()
+	} else {
+		job.startWorkers(concurrency)
+	}
+
+	// wait until all workers are done, once they're all counted in wg
+	go job.startCompletionWaiter()
+	return nil
+}
+
+// fail moves the job to ErrorState and stops its workers, other jobs are unaffected
+func (job *Job) fail(err error) error {
+	failure := &JobFailedError{job.ID, err}
+	job.failure.Store(failure.Error())
+	atomic.StoreInt64(&job.State, ErrorState)
+	job.stopOnce.Do(func() { close(job.quit) })
+	job.log(levelError, "job failed", "error", err)
+	return failure
 }
 
-// AddInputsToJob adds more than one input to the job
+// log writes a log line with the job ID
+func (job *Job) log(level int, message string, keyvals ...interface{}) {
+	logEvent(level, message, append([]interface{}{"job", job.ID}, keyvals...)...)
+}
+
+// AddInputsToJob adds more than one input to the job. The job lock isn't held while
+// the queue is full: the inputs are pending already, so the job can't complete meanwhile
 func (job *Job) AddInputsToJob(inputs []Input) error {
 	job.Lock()
-	defer job.Unlock()
-
 	if !job.canReceiveInput() {
+		job.Unlock()
 		return fmt.Errorf("Job %s can't receive more inputs", job.ID)
 	}
+	if err := job.tenant.queueInputs(len(inputs)); err != nil {
+		job.Unlock()
+		return err
+	}
+	if job.fanOut != nil {
+		job.markInputsSeen(inputs)
+	}
 	job.receiving(len(inputs))
-	for _, eachJob := range inputs {
-		job.inChan <- eachJob
+	atomic.AddInt64(&job.pending, int64(len(inputs)))
+	job.Unlock()
+
+	for index, eachJob := range inputs {
+		if !job.queue.push(eachJob, false, job.quit) {
+			job.tenant.inputsDequeued(len(inputs) - index)
+			atomic.AddInt64(&job.pending, -int64(len(inputs)-index))
+			return fmt.Errorf("Job %s is stopping", job.ID)
+		}
 	}
 	return nil
 }
 
+// Stop stops the workers once their webhook calls are done, checkpoints the inputs
+// which weren't sent, and closes the outputs storage with the state of the job.
+// Returns an error if ctx expires before the workers are done
+func (job *Job) Stop(ctx context.Context) error {
+	job.stopOnce.Do(func() { close(job.quit) })
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return fmt.Errorf("Job %s didn't stop in time: %v", job.ID, ctx.Err())
+	}
+	err := job.checkpoint()
+	if job.outputsDB == nil { // never started
+		return err
+	}
+	job.closeOnce.Do(func() {
+		if saveErr := job.saveStopped(); err == nil {
+			err = saveErr
+		}
+		if closeErr := job.outputsDB.Close(); err == nil {
+			err = closeErr
+		}
+		atomic.AddInt64(&openDatabases, -1)
+	})
+	return err
+}
+
 // AddToJob adds an input to the job
 func (job *Job) AddToJob(key string, value []byte) error {
 	array := make([]Input, 1)
@@ -128,19 +327,38 @@ func (job *Job) AddToJob(key string, value []byte) error {
 
 // AllInputsWereSent is called when all inputs have been sent
 // no more input can be sent
-// the job can't become "complete" until this function is called
+// the job can't become "complete" until this function is called.
+// A job without inputs completes right away
 func (job *Job) AllInputsWereSent() error {
+	job.Lock()
+	defer job.Unlock()
 	state := atomic.LoadInt64(&job.State)
-	if state != ReceivingInputs {
-		close(job.inChan)
+	if state != ReceivingInputs && state != Created {
 		atomic.StoreInt64(&job.State, ErrorState)
+		job.stopOnce.Do(func() { close(job.quit) })
 		return fmt.Errorf("Wrong state transition")
 	}
 	atomic.StoreInt64(&job.State, AllInputReceived)
-	close(job.inChan) // close will trigger each worker goroutine's exit
+	if atomic.LoadInt64(&job.pending) == 0 {
+		job.closeInputs()
+	}
 	return nil
 }
 
+// closeInputs closes the queue, which will trigger each worker goroutine's exit.
+// It's called once all inputs were sent and all of them got an output, so retries can still be queued until then
+func (job *Job) closeInputs() {
+	job.queue.close()
+}
+
+// reply sends the output of an input to outChan, the input is done
+func (job *Job) reply(output Output) {
+	job.outChan <- output
+	if atomic.AddInt64(&job.pending, -1) == 0 && atomic.LoadInt64(&job.State) == AllInputReceived {
+		job.closeInputs()
+	}
+}
+
 // GetInputsCount returns the current number of inputs in the job
 func (job *Job) GetInputsCount() int64 {
 	return atomic.LoadInt64(&job.inputsCount)
@@ -162,129 +380,293 @@ func (job *Job) GetCompletionRate() float64 {
 
 // GetResult returns the result for a key after all outputs are received, or nil if not found
 func (job *Job) GetResult(key string) []byte {
-	if job.State != AllOutputReceived {
+	if atomic.LoadInt64(&job.State) != AllOutputReceived {
 		return nil
 	}
-	value, err := job.outputsDB.Get([]byte(key), nil)
-	if err != nil {
+	output, err := job.GetOutput(key)
+	if err != nil || output == nil {
 		return nil
 	}
-	return value
+	return output.Value
+}
+
+// GetOutput returns the output for a key, or nil if not found.
+// Unlike GetResult, it can be called before all outputs are received
+func (job *Job) GetOutput(key string) (*Output, error) {
+	stored, err := job.outputsDB.Get([]byte(outputPrefix+key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeOutput(key, stored)
 }
 
 // GetResults returns all Outputs
 func (job *Job) GetResults() ([]*Output, error) {
-	if job.State != AllOutputReceived {
+	if atomic.LoadInt64(&job.State) != AllOutputReceived {
 		return nil, fmt.Errorf("Can't get results before all outputs are received")
 	}
 	var result []*Output
-	iter := job.outputsDB.NewIterator(nil, nil)
+	err := job.EachOutput(func(output *Output) error {
+		result = append(result, output)
+		return nil
+	})
+	return result, err
+}
+
+// EachOutput calls fn with each output stored, in key order, until fn returns an error
+func (job *Job) EachOutput(fn func(*Output) error) error {
+	iter := job.outputsDB.NewIterator(util.BytesPrefix([]byte(outputPrefix)), nil)
+	defer iter.Release()
 	for iter.Next() {
-		value := iter.Value()
-		dst := make([]byte, len(value))
-		copy(dst, value)
-		output := &Output{
-			Key:   string(iter.Key()),
-			Value: dst,
+		output, err := decodeOutput(string(iter.Key()[len(outputPrefix):]), iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(output); err != nil {
+			return err
 		}
-		result = append(result, output)
 	}
-	iter.Release()
-	err := iter.Error()
-	return result, err
+	return iter.Error()
 }
 
 // startOutputLogger receives all outputs
 func (job *Job) startOutputLogger() {
-	var err error
-	job.outputsDB, err = leveldb.OpenFile(dbPath+"/job/"+job.ID, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+	failed := false
 	for result := range job.outChan {
+		if failed { // keep receiving so workers don't block
+			continue
+		}
 		atomic.AddInt64(&job.outputsCount, int64(1))
-		// TODO use a key prefix to differenciate from errors
-		// TODO store errors too
-		err = job.outputsDB.Put([]byte(result.Key), result.Value, nil)
+		if err := job.store([]byte(outputPrefix+result.Key), encodeOutput(result)); err != nil {
+			job.fail(fmt.Errorf("Can't store output for %s: %v", result.Key, err))
+			failed = true
+			continue
+		}
+		if job.aggregates != nil {
+			job.aggregates.add(&result)
+		}
+		if job.onOutput != nil {
+			job.onOutput(result)
+		}
 	}
+	job.tenant.jobFinished()
 	job.Complete <- true // indicates all results were received, won't block
 	close(job.Complete)
+	if job.onComplete != nil {
+		job.onComplete()
+	}
+	if !failed && atomic.LoadInt64(&job.State) == AllOutputReceived {
+		// restored jobs which were complete already don't reduce or push again
+		if job.reducer != nil && job.reducer.getStatus().State == reducePending {
+			job.runReduce()
+		}
+		if job.sink != nil && job.sink.getStatus().State == sinkPending {
+			job.runSink()
+		}
+	}
+	close(job.done)
+}
+
+// store writes to the outputs storage, counting the disk usage of the job
+func (job *Job) store(key []byte, value []byte) error {
+	if err := job.outputsDB.Put(key, value, nil); err != nil {
+		return err
+	}
+	size := int64(len(key) + len(value))
+	atomic.AddInt64(&job.diskUsage, size)
+	job.tenant.addDiskUsage(size)
+	return nil
+}
+
+// remove deletes from the outputs storage, counting the disk usage of the job
+func (job *Job) remove(key []byte) {
+	value, err := job.outputsDB.Get(key, nil)
+	if err != nil {
+		return
+	}
+	if job.outputsDB.Delete(key, nil) == nil {
+		size := int64(len(key) + len(value))
+		atomic.AddInt64(&job.diskUsage, -size)
+		job.tenant.addDiskUsage(-size)
+	}
 }
 
 // startOne starts a single worker, doesn't create goroutine
 func (job *Job) startOne() {
 	defer job.wg.Done()
 	for {
-		input, ok := <-job.inChan
-		if !ok { // no more work to do
+		select {
+		case <-job.quit: // stopping, inputs left will be checkpointed
+			return
+		default:
+		}
+		if job.batchSize > 1 {
+			inputs := job.queue.popBatch(job.batchSize, job.batchWait, job.quit)
+			if inputs == nil { // no more work to do, or stopping
+				break
+			}
+			job.tenant.inputsDequeued(len(inputs))
+			job.processBatch(inputs)
+			continue
+		}
+		input, ok := job.queue.pop(job.quit)
+		if !ok { // no more work to do, or stopping
 			break
 		}
+		job.tenant.inputsDequeued(1)
+		job.process(input)
+	}
+}
 
-		// make http request to backend URL
-		reply := Output{Key: input.Key}
+// process sends an input to the webhook, then sends the reply to outChan or requeues the input
+func (job *Job) process(input Input) {
+	// make http request to backend URL
+	reply := Output{Key: input.Key}
 
-		client := &http.Client{
-			Timeout: time.Second * 30, // TODO job param
+	req, body, errRequest := job.request.newRequest(input)
+	if errRequest != nil {
+		error := &OutputError{
+			Message: "Can't create request to the backend endpoint: " + errRequest.Error(),
+		}
+		job.log(levelWarn, "can't create webhook request", "key", input.Key, "error", errRequest)
+		reply.Error = error
+		job.reply(reply)
+		return
+	}
+	req.Header.Add("PMMAP-job", job.ID)
+	if job.plaintext {
+		req.Header.Add("PMMAP-auth", job.secretKey)
+	}
+	signature.SignRequest(req, job.secretKey, body, time.Now())
+	var waiting chan *callback
+	if job.async != nil { // the callback may come before the webhook replies
+		waiting = job.async.register(input.Key)
+	}
+	if !Scheduler.acquire(job, job.quit) { // stopping, the input is checkpointed
+		if waiting != nil {
+			job.async.unregister(input.Key, waiting)
+		}
+		job.requeue(input)
+		return
+	}
+	start := time.Now()
+	res, errResponse := job.client.Do(req)
+	latency := time.Since(start)
+	Scheduler.release(job)
+	if errResponse != nil {
+		if waiting != nil {
+			job.async.unregister(input.Key, waiting)
+		}
+		job.recordAttempt(input.Key, newAttempt(input, start, latency, 0, nil, errResponse))
+		job.log(levelWarn, "webhook call failed", "key", input.Key, "attempt", input.retryCount+1, "latency", latency, "error", errResponse)
+		input.retryCount++
+		job.requeue(input) // TODO exponential backup
+		return
+	}
+	defer res.Body.Close()
+	job.log(levelDebug, "webhook called", "key", input.Key, "attempt", input.retryCount+1, "status", res.StatusCode, "latency", latency)
+
+	replyBody, readerr := ioutil.ReadAll(res.Body)
+	job.recordAttempt(input.Key, newAttempt(input, start, latency, res.StatusCode, replyBody, readerr))
+	if waiting != nil && (res.StatusCode != http.StatusAccepted || readerr != nil) {
+		job.async.unregister(input.Key, waiting)
+	} else if waiting != nil {
+		reply := job.awaitCallback(input, waiting)
+		if reply == nil { // retried, failed or checkpointed
+			return
 		}
-		bodyreader := bytes.NewReader(input.Value)
-		req, errRequest := http.NewRequest("POST", job.workURL.String()+"/"+input.Key, bodyreader)
-		if errRequest != nil {
+		res, replyBody = reply.response, reply.body
+		latency = time.Since(start)
+		job.log(levelDebug, "webhook called back", "key", input.Key, "status", res.StatusCode, "latency", latency)
+	}
+	if job.metadata {
+		reply.Metadata = job.newMetadata(res, latency)
+	}
+
+	if job.isSuccess(res.StatusCode) {
+		if len(replyBody) > 0 {
+			reply.Value = replyBody
+		}
+		reply.ContentType = res.Header.Get("Content-Type")
+		if readerr != nil {
 			error := &OutputError{
-				Message: "Can't create POST request to the backend endpoint",
+				Message: "Can't read body from response",
 			}
+			job.log(levelWarn, "can't read webhook reply", "key", input.Key, "attempt", input.retryCount+1, "status", res.StatusCode, "error", readerr)
 			reply.Error = error
-			job.outChan <- reply
-			continue
+			job.reply(reply)
+			return
 		}
-		req.Header.Add("PMMAP-job", job.ID)
-		req.Header.Add("PMMAP-auth", job.secretKey)
-		req.Header.Add("Content-Type", "application/json")
-		res, errResponse := client.Do(req)
-		if errResponse != nil {
-			input.retryCount++
-			job.inChan <- input // TODO exponential backup
-			continue
-		}
-		defer res.Body.Close()
-
-		if res.StatusCode == http.StatusOK {
-			var readerr error
-			reply.Value, readerr = ioutil.ReadAll(res.Body)
-			if readerr != nil {
-				error := &OutputError{
-					Message: "Can't read body from response",
-				}
-				reply.Error = error
-				job.outChan <- reply
-				continue
+		if job.fanOut != nil && mediaType(reply.ContentType) == envelopeContentType {
+			value, err := job.openEnvelope(input.Key, replyBody)
+			if err != nil {
+				job.log(levelWarn, "can't open webhook envelope", "key", input.Key, "error", err)
+				reply.Error = &OutputError{Message: err.Error()}
+				reply.Value = nil
+				job.reply(reply)
+				return
 			}
-			reply.Error = nil
-			job.outChan <- reply
-			continue
+			reply.Value = value
+			reply.ContentType = "application/json"
 		}
-		if res.StatusCode >= 500 || input.retryCount < 5 { // retryable error // TODO job param max retries
-			input.retryCount++
-			job.inChan <- input
-		} else { // fatal error
-			error := &OutputError{}
-			error.StatusCode = res.StatusCode
-			if b, berr := ioutil.ReadAll(res.Body); berr == nil {
-				error.Body = string(b)
-			}
-			log.Printf("Backend replied %d for %s", res.StatusCode, input.Key)
+		reply.Error = nil
+		job.reply(reply)
+		return
+	}
+	if res.StatusCode >= 500 || input.retryCount < job.maxRetries { // retryable error
+		input.retryCount++
+		job.requeue(input)
+	} else { // fatal error
+		error := &OutputError{}
+		error.StatusCode = res.StatusCode
+		if readerr == nil {
+			error.Body = string(replyBody)
+		}
+		job.log(levelWarn, "webhook rejected input", "key", input.Key, "attempt", input.retryCount+1, "status", res.StatusCode, "latency", latency)
 
-			reply.Error = error
-			reply.Value = nil
-			job.outChan <- reply
+		reply.Error = error
+		reply.Value = nil
+		job.reply(reply)
+	}
+}
+
+// isSuccess tells if a webhook status code gives an output
+func (job *Job) isSuccess(statusCode int) bool {
+	for _, code := range job.successCodes {
+		if code == statusCode {
+			return true
 		}
 	}
+	return false
 }
 
-// startCompletionWaiter runs a goroutine that's waiting until completion
+// newMetadata returns the metadata of a webhook reply, with the headers selected by the job
+func (job *Job) newMetadata(res *http.Response, latency time.Duration) *OutputMetadata {
+	metadata := &OutputMetadata{StatusCode: res.StatusCode, Latency: latency.Nanoseconds() / int64(time.Millisecond)}
+	for _, name := range job.keepHeaders {
+		if value := res.Header.Get(name); value != "" {
+			if metadata.Headers == nil {
+				metadata.Headers = make(map[string]string)
+			}
+			metadata.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return metadata
+}
+
+// startCompletionWaiter runs a goroutine that's waiting until completion.
+// Workers exit once the queue is closed, which happens when all inputs were sent
+// and none is pending, including the inputs spawned by the webhook
 func (job *Job) startCompletionWaiter() {
 	job.wg.Wait()
-	atomic.StoreInt64(&job.State, AllOutputReceived)
+	select {
+	case <-job.quit: // workers were stopped, outputs are incomplete
+	default:
+		atomic.StoreInt64(&job.State, AllOutputReceived)
+	}
 
 	close(job.outChan) // don't let anyone write to it anymore
 }
@@ -298,6 +680,39 @@ func (job *Job) startWorkers(concurrency int) {
 	}
 }
 
+// requeue sends an input back to the queue, to be retried
+func (job *Job) requeue(input Input) {
+	job.tenant.requeueInput()
+	job.queue.push(input, true, nil) // workers may be gone, it's kept for the checkpoint
+}
+
+// checkpoint saves the inputs which weren't sent to the webhook to
+// a JSON file in the checkpoint directory, which can be sent as is to
+// PUT /job/{id}/input. Nothing is saved if all inputs were sent
+func (job *Job) checkpoint() error {
+	inputs := job.queue.drain()
+	if len(inputs) == 0 {
+		return nil
+	}
+	job.tenant.inputsDequeued(len(inputs))
+
+	result := make([]kvJSON, len(inputs))
+	for index, input := range inputs {
+		value, encoding := encodeValue(input.Value, "")
+		result[index] = kvJSON{Key: input.Key, Value: value, Encoding: encoding, Priority: input.Priority}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(config.DataDir, "checkpoint")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	job.log(levelInfo, "inputs checkpointed", "count", len(inputs))
+	return ioutil.WriteFile(filepath.Join(dir, job.ID+".json"), b, 0644)
+}
+
 // canReceiveInput tells whether it's OK to accept new inputs
 func (job *Job) canReceiveInput() bool {
 	state := atomic.LoadInt64(&job.State)
@@ -308,7 +723,7 @@ func (job *Job) canReceiveInput() bool {
 func (job *Job) receiving(count int) {
 	state := atomic.LoadInt64(&job.State)
 	if state != Created && state != ReceivingInputs {
-		log.Print("Job receiving inputs while not in right state")
+		job.log(levelWarn, "job receiving inputs while not in right state", "state", stateNames[state])
 		return
 	}
 	atomic.StoreInt64(&job.State, ReceivingInputs)
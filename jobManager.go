@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 // manager holds jobs
@@ -25,8 +29,58 @@ func (man *manager) getJob(id string) *Job {
 	return man.jobs[id]
 }
 
+// delJob stops a job once its webhook calls are done, deletes its outputs and checkpoint,
+// then gives its quotas back to its tenant
 func (man *manager) delJob(id string) {
 	man.Lock()
-	defer man.Unlock()
+	job, ok := man.jobs[id]
 	delete(man.jobs, id)
+	man.Unlock()
+	if !ok {
+		return
+	}
+	if err := job.Stop(context.Background()); err != nil {
+		job.log(levelWarn, "job didn't stop cleanly", "error", err)
+	}
+	os.RemoveAll(filepath.Join(config.DataDir, "job", job.ID))
+	os.Remove(filepath.Join(config.DataDir, "checkpoint", job.ID+".json"))
+	job.tenant.addDiskUsage(-atomic.LoadInt64(&job.diskUsage))
+	job.log(levelInfo, "job deleted")
+}
+
+func (man *manager) count() int {
+	man.RLock()
+	defer man.RUnlock()
+	return len(man.jobs)
+}
+
+// stopAll stops every job, returns the first error if some didn't stop in time
+func (man *manager) stopAll(ctx context.Context) error {
+	jobs := man.snapshot()
+	errs := make(chan error, len(jobs))
+	for _, job := range jobs {
+		go func(job *Job) { errs <- job.Stop(ctx) }(job)
+	}
+
+	var result error
+	for range jobs {
+		if err := <-errs; err != nil {
+			logEvent(levelError, "job didn't stop cleanly", "error", err)
+			if result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// snapshot returns all jobs
+func (man *manager) snapshot() []*Job {
+	man.RLock()
+	defer man.RUnlock()
+	jobs := make([]*Job, 0, len(man.jobs))
+	for _, job := range man.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
 }
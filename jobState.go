@@ -16,3 +16,6 @@ const (
 	// ErrorState indicates this job is in error, no more interaction should occur
 	ErrorState
 )
+
+// stateNames are the names of the states, as reported by the API
+var stateNames = []string{"created", "receivingInputs", "allInputReceived", "allOutputReceived", "error"}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -11,7 +17,10 @@ import (
 // does finish as it should
 func TestCreateWithOneJob(t *testing.T) {
 	u, _ := url.Parse("http://" + localServerAddress + webhook)
-	job := CreateJob(Secret, *u, 10)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
 	job.Start(10)
 
 	if job.GetCompletionRate() != 0 {
@@ -48,7 +57,10 @@ const concurrency = 2
 // TestCreateWithNJobs tests with N jobs (N = _count)
 func TestCreateWithNjobs(t *testing.T) {
 	u, _ := url.Parse("http://" + localServerAddress + webhook)
-	job := CreateJob(Secret, *u, _count)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, _count)
+	if err != nil {
+		t.Fatal(err)
+	}
 	job.Start(2)
 	if job.GetCompletionRate() != 0 {
 		t.Fatalf("Job completion rate should be 0, it is %f", job.GetCompletionRate())
@@ -79,3 +91,98 @@ func TestCreateWithNjobs(t *testing.T) {
 		t.Fatalf("result should be returned %s", string(job.GetResult("hello0")))
 	}
 }
+
+// TestStopCheckpoints tests that stopping a job lets the call in flight finish,
+// and checkpoints the inputs which weren't sent
+func TestStopCheckpoints(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`"done"`))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Start(1)
+	for c := 0; c < 3; c++ {
+		job.AddToJob("key"+strconv.Itoa(c), []byte(`"value"`))
+	}
+	time.Sleep(20 * time.Millisecond) // let the worker call the backend
+
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stopped <- job.Stop(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond) // let Stop signal the worker
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if job.GetOutputsCount() != 1 {
+		t.Fatalf("the call in flight should have finished, there are %d outputs", job.GetOutputsCount())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(config.DataDir, "checkpoint", job.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs []kvJSON
+	json.Unmarshal(b, &inputs)
+	if len(inputs) != 2 || inputs[0].Key != "key1" || inputs[0].Value != "value" {
+		t.Fatalf("2 inputs should have been checkpointed: %s", string(b))
+	}
+}
+
+// TestDeleteJob tests that deleting a running job stops it, deletes its files
+// and gives its quotas back to its tenant
+func TestDeleteJob(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`"done"`))
+	}))
+	defer backend.Close()
+
+	tenant, _ := Tenants.setTenant("deleting", "", Tenant{})
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(tenant, Secret, *u, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Start(1)
+	Manager.addJob(job)
+	for c := 0; c < 3; c++ {
+		job.AddToJob("key"+strconv.Itoa(c), []byte(`"value"`))
+	}
+	time.Sleep(20 * time.Millisecond) // let the worker call the backend
+
+	deleted := make(chan *http.Response)
+	go func() {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/job/"+job.ID, nil)
+		req.Header.Set("PMMAP-tenant", "deleting")
+		res, _ := http.DefaultClient.Do(req)
+		deleted <- res
+	}()
+	time.Sleep(20 * time.Millisecond) // let the call in flight block the deletion
+	close(release)
+	if res := <-deleted; res == nil || res.StatusCode != http.StatusOK {
+		t.Fatal("DELETE should reply with 200")
+	}
+	if Manager.getJob(job.ID) != nil {
+		t.Fatal("the job should be deleted")
+	}
+	if _, err := ioutil.ReadDir(filepath.Join(config.DataDir, "job", job.ID)); err == nil {
+		t.Fatal("the outputs of the job should be deleted")
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(config.DataDir, "checkpoint", job.ID+".json")); err == nil {
+		t.Fatal("the checkpoint of the job should be deleted")
+	}
+	if tenant.jobs != 0 || tenant.queuedInputs != 0 || tenant.diskUsage != 0 {
+		t.Fatalf("the quotas of the job should be released: %d jobs, %d inputs, %d bytes", tenant.jobs, tenant.queuedInputs, tenant.diskUsage)
+	}
+}
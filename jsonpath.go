@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSON path like $.value.items[0].name or $.metadata.headers['X-Cache'].
+// Its steps are object member names (strings) and array indexes (ints)
+type jsonPath []interface{}
+
+// parseJSONPath parses a JSON path, it must start with $
+func parseJSONPath(expression string) (jsonPath, error) {
+	if !strings.HasPrefix(expression, "$") {
+		return nil, fmt.Errorf("JSON path %q must start with $", expression)
+	}
+	var path jsonPath
+	rest := expression[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("JSON path %q has an empty member name", expression)
+			}
+			path = append(path, rest[1:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSON path %q has an unclosed [", expression)
+			}
+			step := rest[1:end]
+			if len(step) >= 2 && (step[0] == '\'' || step[0] == '"') && step[len(step)-1] == step[0] {
+				path = append(path, step[1:len(step)-1])
+			} else if index, err := strconv.Atoi(step); err == nil && index >= 0 {
+				path = append(path, index)
+			} else {
+				return nil, fmt.Errorf("JSON path %q has an invalid step [%s]", expression, step)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSON path %q is invalid at %q", expression, rest)
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at the path in a decoded JSON document, false if there's none
+func (path jsonPath) lookup(document interface{}) (interface{}, bool) {
+	value := document
+	for _, step := range path {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			name, ok := step.(string)
+			if value, ok = typed[name]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, ok := step.(int)
+			if !ok || index >= len(typed) {
+				return nil, false
+			}
+			value = typed[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
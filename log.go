@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log levels, from the most verbose
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logOutput is where log lines are written
+var (
+	logLock   sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+// logEvent writes a log line if its level is enabled in the configuration.
+// keyvals are pairs of field names and values, like "job", job.ID
+func logEvent(level int, message string, keyvals ...interface{}) {
+	if level < logLevels[config.LogLevel] {
+		return
+	}
+	names := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), levelNames[level], message}
+	for index := 0; index+1 < len(keyvals); index += 2 {
+		names = append(names, fmt.Sprint(keyvals[index]))
+		value := keyvals[index+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		values = append(values, value)
+	}
+
+	var line bytes.Buffer
+	if config.LogFormat == "json" {
+		object := make(map[string]interface{}, len(names))
+		for index, name := range names {
+			if duration, ok := values[index].(time.Duration); ok {
+				object[name] = duration.Nanoseconds() / int64(time.Millisecond)
+			} else {
+				object[name] = values[index]
+			}
+		}
+		json.NewEncoder(&line).Encode(object)
+	} else {
+		for index, name := range names {
+			if index > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(name)
+			line.WriteByte('=')
+			line.WriteString(logfmtValue(values[index]))
+		}
+		line.WriteByte('\n')
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOutput.Write(line.Bytes())
+}
+
+// logfmtValue formats a value for logfmt, quoting it when needed
+func logfmtValue(value interface{}) string {
+	var text string
+	switch typed := value.(type) {
+	case string:
+		text = typed
+	case time.Duration:
+		text = strconv.FormatInt(typed.Nanoseconds()/int64(time.Millisecond), 10) + "ms"
+	default:
+		text = fmt.Sprint(value)
+	}
+	if text == "" || strings.ContainsAny(text, " =\"\t\n") {
+		return strconv.Quote(text)
+	}
+	return text
+}
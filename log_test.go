@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs returns what logEvent writes while f runs, in the given format
+func captureLogs(format string, f func()) string {
+	var output bytes.Buffer
+	logLock.Lock()
+	previous := logOutput
+	logOutput = &output
+	logLock.Unlock()
+	previousFormat := config.LogFormat
+	config.LogFormat = format
+	defer func() {
+		config.LogFormat = previousFormat
+		logLock.Lock()
+		logOutput = previous
+		logLock.Unlock()
+	}()
+	f()
+	return output.String()
+}
+
+func TestLogFormats(t *testing.T) {
+	line := captureLogs("logfmt", func() {
+		logEvent(levelWarn, "webhook call failed", "job", "42", "latency", 1500*time.Millisecond, "error", errors.New("connection refused"))
+	})
+	if !strings.Contains(line, `level=warn msg="webhook call failed" job=42 latency=1500ms error="connection refused"`) {
+		t.Fatalf("logfmt line isn't right: %s", line)
+	}
+
+	line = captureLogs("json", func() {
+		logEvent(levelInfo, "webhook called", "key", "hello", "status", 200)
+	})
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["msg"] != "webhook called" || fields["key"] != "hello" || fields["status"].(float64) != 200 {
+		t.Fatalf("json line isn't right: %s", line)
+	}
+
+	if line = captureLogs("logfmt", func() { logEvent(levelDebug, "hidden") }); line != "" {
+		t.Fatalf("debug lines should be hidden at info level: %s", line)
+	}
+}
+
+// TestJobFailure tests that a job whose storage can't be opened fails alone
+func TestJobFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pmmap")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "job"), []byte("not a directory"), 0644)
+	previous := config.DataDir
+	config.DataDir = dir
+	defer func() { config.DataDir = previous }()
+
+	u, _ := url.Parse("http://" + localServerAddress + webhook)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLogs("logfmt", func() { err = job.Start(1) })
+	if _, ok := err.(*JobFailedError); !ok {
+		t.Fatalf("job should have failed, got %v", err)
+	}
+	if job.State != ErrorState {
+		t.Fatalf("job should be in error state, it is %s", stateNames[job.State])
+	}
+}
@@ -1,16 +1,101 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 )
 
+// ListenAddress and the TLS files are the default settings, they can be set at build time with -ldflags "-X main.ListenAddress=:8080"
 var (
 	// ListenAddress specifies the address to listen to
 	ListenAddress = "localhost:8080"
+
+	// TLSCertFile and TLSKeyFile are PEM files, the API is served over TLS when they're set
+	TLSCertFile = ""
+	TLSKeyFile  = ""
+
+	// TLSClientCAFile is a PEM CA bundle, API clients must present a certificate signed by one of its CAs when it's set
+	TLSClientCAFile = ""
 )
 
+// shuttingDown is set to 1 when the server stops accepting new jobs
+var shuttingDown int32
+
 func main() {
-	log.Print("Starting PMmap on ", ListenAddress)
-	panic(http.ListenAndServe(ListenAddress, routes()))
+	loaded, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config = loaded
+	os.Exit(serve())
+}
+
+// serve runs the API server with the current configuration until SIGINT or SIGTERM.
+// Returns the exit status: 0 if all jobs were stopped cleanly, 1 otherwise
+func serve() int {
+	logEvent(levelInfo, "starting PMmap", "listen", config.ListenAddress)
+	if err := loadServerState(); err != nil {
+		logEvent(levelError, "can't load the server state", "error", err)
+		return 1
+	}
+	Tenants.configureDefault()
+	srv := &http.Server{
+		Addr:    config.ListenAddress,
+		Handler: routes(),
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	failed := make(chan error, 1)
+	go func() {
+		if config.TLSCertFile == "" {
+			failed <- srv.ListenAndServe()
+			return
+		}
+		tlsConfig, err := serverTLSConfig(config.TLSClientCAFile)
+		if err != nil {
+			failed <- err
+			return
+		}
+		srv.TLSConfig = tlsConfig
+		failed <- srv.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	}()
+
+	select {
+	case err := <-failed:
+		logEvent(levelError, "server failed", "error", err)
+		return 1
+	case sig := <-signals:
+		logEvent(levelInfo, "shutting down", "signal", sig.String())
+	}
+	return shutdown(srv)
+}
+
+// shutdown stops accepting jobs, lets webhook calls in flight finish within
+// the grace period, checkpoints inputs left and closes the outputs storage
+func shutdown(srv *http.Server) int {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGrace)
+	defer cancel()
+
+	status := 0
+	if err := Manager.stopAll(ctx); err != nil {
+		status = 1
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		logEvent(levelError, "API requests didn't finish in time", "error", err)
+		status = 1
+	}
+	logEvent(levelInfo, "PMmap stopped", "status", status)
+	return status
 }
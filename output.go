@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// value encodings in the API
+const (
+	encodingJSON   = "json"   // the value is any JSON
+	encodingRaw    = "raw"    // the value is a JSON string, its text is the value
+	encodingBase64 = "base64" // the value is a JSON string, base64 encoded
+)
+
+// outputMeta is stored before the value of each output
+type outputMeta struct {
+	ContentType string          `json:"contentType,omitempty"`
+	Error       *OutputError    `json:"error,omitempty"`
+	Metadata    *OutputMetadata `json:"metadata,omitempty"`
+}
+
+// encodeOutput returns the stored form of an output: the length of its metadata, its metadata as JSON, then the raw value
+func encodeOutput(output Output) []byte {
+	meta, _ := json.Marshal(outputMeta{output.ContentType, output.Error, output.Metadata})
+	result := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(meta)+len(output.Value))
+	result = append(result[:binary.PutUvarint(result, uint64(len(meta)))], meta...)
+	return append(result, output.Value...)
+}
+
+// decodeOutput reads an output stored with encodeOutput, value is copied
+func decodeOutput(key string, stored []byte) (*Output, error) {
+	length, read := binary.Uvarint(stored)
+	if read <= 0 || uint64(len(stored)-read) < length {
+		return nil, fmt.Errorf("Corrupted output for %s", key)
+	}
+	var meta outputMeta
+	if err := json.Unmarshal(stored[read:read+int(length)], &meta); err != nil {
+		return nil, fmt.Errorf("Corrupted output for %s: %v", key, err)
+	}
+	value := make([]byte, len(stored)-read-int(length))
+	copy(value, stored[read+int(length):])
+	return &Output{Key: key, Value: value, ContentType: meta.ContentType, Error: meta.Error, Metadata: meta.Metadata}, nil
+}
+
+// mediaType returns the media type of a content type, "" if empty or invalid
+func mediaType(contentType string) string {
+	result, _, _ := mime.ParseMediaType(contentType)
+	return result
+}
+
+// mayBeJSON tells if a value with this content type can be JSON. Many backends
+// don't set their content type, so text/plain (what Go sniffs) is accepted too
+func mayBeJSON(contentType string) bool {
+	switch media := mediaType(contentType); {
+	case contentType == "", media == "application/json", media == "text/plain":
+		return true
+	default:
+		return strings.HasSuffix(media, "+json")
+	}
+}
+
+// encodeValue returns a value for the JSON API, and its encoding.
+// JSON values are returned as is, text as a raw string, others as base64 strings
+func encodeValue(value []byte, contentType string) (interface{}, string) {
+	if len(value) == 0 {
+		return nil, ""
+	}
+	if mayBeJSON(contentType) && json.Valid(value) {
+		return json.RawMessage(value), ""
+	}
+	if strings.HasPrefix(mediaType(contentType), "text/") && utf8.Valid(value) {
+		return string(value), encodingRaw
+	}
+	return base64.StdEncoding.EncodeToString(value), encodingBase64
+}
+
+// decodeValue returns the bytes of a value received from the JSON API
+func decodeValue(value json.RawMessage, encoding string) ([]byte, error) {
+	if encoding == "" || encoding == encodingJSON {
+		if value == nil {
+			return []byte("null"), nil
+		}
+		var compact bytes.Buffer
+		err := json.Compact(&compact, value)
+		return compact.Bytes(), err
+	}
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		return nil, fmt.Errorf("A %s value must be a JSON string", encoding)
+	}
+	switch encoding {
+	case encodingRaw:
+		return []byte(text), nil
+	case encodingBase64:
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return nil, fmt.Errorf("Unknown encoding %s", encoding)
+}
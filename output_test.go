@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOutputEncoding(t *testing.T) {
+	output := Output{Key: "k", Value: []byte{0, 1, 255}, ContentType: "image/png", Error: &OutputError{StatusCode: 418}}
+	decoded, err := decodeOutput("k", encodeOutput(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Value, output.Value) || decoded.ContentType != "image/png" || decoded.Error.StatusCode != 418 {
+		t.Fatalf("output should survive storage: %+v", decoded)
+	}
+	if _, err := decodeOutput("k", []byte{42}); err == nil {
+		t.Fatal("corrupted outputs should be detected")
+	}
+
+	for _, test := range []struct {
+		value, contentType, encoding string
+	}{
+		{`{"a":1}`, "", ""},
+		{`"text"`, "text/plain; charset=utf-8", ""},
+		{`{"a":1}`, "application/problem+json", ""},
+		{"hello world", "text/plain", encodingRaw},
+		{"<a/>", "application/xml", encodingBase64},
+		{"\xff\x00", "text/plain", encodingBase64},
+	} {
+		value, encoding := encodeValue([]byte(test.value), test.contentType)
+		if encoding != test.encoding {
+			t.Fatalf("%q as %s should be encoded as %q, not %q", test.value, test.contentType, test.encoding, encoding)
+		}
+		encoded, _ := json.Marshal(value)
+		if back, err := decodeValue(encoded, encoding); err != nil || string(back) != test.value {
+			t.Fatalf("%q should be decoded back, got %q (%v)", test.value, back, err)
+		}
+	}
+
+	if _, err := decodeValue(json.RawMessage(`12`), encodingBase64); err == nil {
+		t.Fatal("base64 values must be strings")
+	}
+	if _, err := decodeValue(json.RawMessage(`"x"`), "gzip"); err == nil {
+		t.Fatal("unknown encodings should be rejected")
+	}
+}
+
+// TestBinaryOutputs sends binary inputs to a backend replying with binary outputs
+func TestBinaryOutputs(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/octet-stream" {
+			t.Errorf("the job content type should be used, not %s", req.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(append(body, 0xff))
+	}))
+	defer backend.Close()
+
+	b, _ := json.Marshal(map[string]interface{}{"secret": Secret, "url": backend.URL, "maxsize": 1, "concurrency": 1, "contentType": "application/octet-stream"})
+	create, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job map[string]interface{}
+	json.NewDecoder(create.Body).Decode(&job)
+	jobURL := "http://localhost:8080/job/" + job["id"].(string)
+
+	put, _ := http.NewRequest("PUT", jobURL+"/input", bytes.NewReader([]byte(`[{"key":"png","value":"AAE=","encoding":"base64"}]`)))
+	if res, err := http.DefaultClient.Do(put); err != nil || res.StatusCode != http.StatusCreated {
+		message, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("base64 inputs should be accepted: %s (%v)", message, err)
+	}
+	http.Post(jobURL+"/complete", "application/json", nil)
+
+	res, err := http.Get(jobURL + "/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs []kvJSON
+	json.NewDecoder(res.Body).Decode(&outputs)
+	if len(outputs) != 1 || outputs[0].Value != "AAH/" || outputs[0].Encoding != encodingBase64 || outputs[0].ContentType != "image/png" {
+		t.Fatalf("binary outputs should be base64 encoded: %+v", outputs)
+	}
+
+	raw, err := http.Get(jobURL + "/output/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(raw.Body)
+	if raw.Header.Get("Content-Type") != "image/png" || !bytes.Equal(body, []byte{0, 1, 0xff}) {
+		t.Fatalf("raw outputs should be returned as is: %s %v", raw.Header.Get("Content-Type"), body)
+	}
+}
+
+// TestOutputMetadata tests that other success codes give outputs, with their metadata
+func TestOutputMetadata(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`"created"`))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.successCodes = []int{http.StatusCreated, http.StatusNoContent}
+	job.metadata = true
+	job.keepHeaders = []string{"x-cache"}
+	job.maxRetries = 0
+	job.Start(1)
+	job.AddToJob("created", []byte(`1`))
+	job.AddToJob("empty", []byte(`2`))
+	job.AllInputsWereSent()
+	<-job.Complete
+
+	outputs, err := job.GetResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0].Error != nil || outputs[1].Error != nil {
+		t.Fatalf("201 and 204 replies should be outputs: %+v", outputs)
+	}
+	created := outputs[0].Metadata
+	if string(outputs[0].Value) != `"created"` || created.StatusCode != http.StatusCreated || created.Headers["X-Cache"] != "HIT" {
+		t.Fatalf("metadata should be stored with outputs: %+v", created)
+	}
+	if len(outputs[1].Value) != 0 || outputs[1].Metadata.StatusCode != http.StatusNoContent {
+		t.Fatalf("204 replies should have an empty value: %+v", outputs[1])
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/satori/go.uuid"
+)
+
+// stageJSON is a stage of a pipeline: a job, with how the outputs of the previous stage become its inputs
+type stageJSON struct {
+	createJobJSON
+	Filter    string `json:"filter"`    // JSON path in outputs of the previous stage, they're sent only if its value is truthy
+	Transform string `json:"transform"` // JSON path in outputs of the previous stage, its value is the input value
+}
+
+type pipelineJSON struct {
+	Stages []stageJSON `json:"stages"`
+}
+
+// stage is a running stage of a pipeline
+type stage struct {
+	job       *Job
+	filter    jsonPath // nil to send every output
+	transform jsonPath // nil to send output values as is
+}
+
+// Pipeline chains jobs: outputs of a stage are sent to the next stage as soon as they're received
+type Pipeline struct {
+	ID     string
+	tenant *Tenant
+	stages []*stage
+}
+
+// pipelineManager holds pipelines
+type pipelineManager struct {
+	sync.RWMutex
+	pipelines map[string]*Pipeline
+}
+
+// Pipelines is the entry point to pipelines
+var Pipelines = pipelineManager{pipelines: make(map[string]*Pipeline)}
+
+func (man *pipelineManager) addPipeline(pipeline *Pipeline) {
+	man.Lock()
+	defer man.Unlock()
+	man.pipelines[pipeline.ID] = pipeline
+}
+
+func (man *pipelineManager) getPipeline(id string) *Pipeline {
+	man.RLock()
+	defer man.RUnlock()
+	return man.pipelines[id]
+}
+
+func (man *pipelineManager) delPipeline(id string) {
+	man.Lock()
+	defer man.Unlock()
+	delete(man.pipelines, id)
+}
+
+// newPipeline creates and starts the jobs of a pipeline.
+// If a stage can't be created, the stages already created are stopped and deleted
+func newPipeline(tenant *Tenant, query *pipelineJSON) (*Pipeline, error) {
+	if len(query.Stages) == 0 {
+		return nil, fmt.Errorf("Pipeline needs at least one stage")
+	}
+	pipeline := &Pipeline{ID: uuid.NewV4().String(), tenant: tenant}
+	for index := range query.Stages {
+		spec := &query.Stages[index]
+		stage := &stage{}
+		var err error
+		if index > 0 && spec.Filter != "" {
+			stage.filter, err = parseJSONPath(spec.Filter)
+		}
+		if err == nil && index > 0 && spec.Transform != "" {
+			stage.transform, err = parseJSONPath(spec.Transform)
+		}
+		if err == nil {
+			stage.job, err = newJob(tenant, &spec.createJobJSON)
+		}
+		if err != nil {
+			pipeline.delete()
+			if _, ok := err.(*QuotaError); ok || err == errTooManyJobs {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Stage %d: %v", index+1, err)
+		}
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+
+	// no input was sent yet, so hooks are set before the first output
+	for index, each := range pipeline.stages[:len(pipeline.stages)-1] {
+		next := pipeline.stages[index+1]
+		each.job.onOutput = next.forward
+		each.job.onComplete = func() { next.job.AllInputsWereSent() }
+	}
+	Pipelines.addPipeline(pipeline)
+	return pipeline, nil
+}
+
+// forward sends an output of the previous stage to the stage, if it passes the filter.
+// Outputs with an error aren't sent
+func (stage *stage) forward(output Output) {
+	if output.Error != nil {
+		return
+	}
+	value := output.Value
+	if stage.filter != nil || stage.transform != nil {
+		document, err := outputDocument(&output)
+		if err != nil {
+			return
+		}
+		if stage.filter != nil {
+			if found, ok := stage.filter.lookup(document); !ok || !truthy(found) {
+				return
+			}
+		}
+		if stage.transform != nil {
+			found, ok := stage.transform.lookup(document)
+			if !ok {
+				return
+			}
+			if value, err = json.Marshal(found); err != nil {
+				return
+			}
+		}
+	}
+	if err := stage.job.AddToJob(output.Key, value); err != nil {
+		stage.job.log(levelWarn, "can't forward output to pipeline stage", "key", output.Key, "error", err)
+	}
+}
+
+// truthy tells if a JSON value passes a filter: anything but null, false, 0 and ""
+func truthy(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typed
+	case string:
+		return typed != ""
+	case json.Number:
+		number, err := typed.Float64()
+		return err != nil || number != 0
+	}
+	return true
+}
+
+// first returns the job receiving the inputs of the pipeline
+func (pipeline *Pipeline) first() *Job {
+	return pipeline.stages[0].job
+}
+
+// last returns the job giving the outputs of the pipeline
+func (pipeline *Pipeline) last() *Job {
+	return pipeline.stages[len(pipeline.stages)-1].job
+}
+
+// delete stops and deletes the jobs of the pipeline
+func (pipeline *Pipeline) delete() {
+	for _, each := range pipeline.stages {
+		Manager.delJob(each.job.ID)
+	}
+	Pipelines.delPipeline(pipeline.ID)
+}
+
+// MarshalJSON gives a JSON representation of a Pipeline, with counters of all stages
+func (pipeline *Pipeline) MarshalJSON() ([]byte, error) {
+	jobs := make([]*Job, len(pipeline.stages))
+	var inputs, outputs int64
+	state := stateNames[atomic.LoadInt64(&pipeline.last().State)]
+	for index, each := range pipeline.stages {
+		jobs[index] = each.job
+		inputs += each.job.GetInputsCount()
+		outputs += each.job.GetOutputsCount()
+		if atomic.LoadInt64(&each.job.State) == ErrorState {
+			state = stateNames[ErrorState]
+		}
+	}
+	return json.Marshal(&struct {
+		ID      string `json:"id"`
+		Tenant  string `json:"tenant"`
+		State   string `json:"state"`
+		Inputs  int64  `json:"inputs"`
+		Outputs int64  `json:"outputs"`
+		Stages  []*Job `json:"stages"`
+	}{pipeline.ID, pipeline.tenant.ID, state, inputs, outputs, jobs})
+}
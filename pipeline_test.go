@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+// TestPipeline chains 2 stages, the second one gets the filtered and transformed outputs of the first one
+func TestPipeline(t *testing.T) {
+	resolve := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := path.Base(req.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{"domain": key + ".com", "ok": key != "skip"})
+	}))
+	defer resolve.Close()
+	check := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write([]byte(`{"checked":` + string(body) + `}`))
+	}))
+	defer check.Close()
+
+	spec, _ := json.Marshal(map[string]interface{}{"stages": []map[string]interface{}{
+		{"secret": Secret, "url": resolve.URL, "maxsize": 10, "concurrency": 2},
+		{"secret": Secret, "url": check.URL, "maxsize": 10, "concurrency": 2, "filter": "$.value.ok", "transform": "$.value.domain"},
+	}})
+	res, err := http.Post("http://localhost:8080/pipeline", "application/json", bytes.NewReader(spec))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("pipeline should be created (%v)", err)
+	}
+	var pipeline struct {
+		ID     string
+		State  string
+		Inputs int
+		Stages []struct{ ID string }
+	}
+	json.NewDecoder(res.Body).Decode(&pipeline)
+	if len(pipeline.Stages) != 2 {
+		t.Fatalf("pipeline should have 2 stages: %+v", pipeline)
+	}
+	pipelineURL := "http://localhost:8080/pipeline/" + pipeline.ID
+
+	put, _ := http.NewRequest("PUT", pipelineURL+"/input", bytes.NewReader([]byte(`[{"key":"a","value":1},{"key":"b","value":2},{"key":"skip","value":3}]`)))
+	if res, err := http.DefaultClient.Do(put); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("inputs should be added to the first stage (%v)", err)
+	}
+	http.Post(pipelineURL+"/complete", "application/json", nil)
+
+	last := Manager.getJob(pipeline.Stages[1].ID)
+	select {
+	case <-last.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the last stage should complete")
+	}
+	outputs, err := last.GetResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || string(outputs[0].Value) != `{"checked":"a.com"}` || string(outputs[1].Value) != `{"checked":"b.com"}` {
+		t.Fatalf("filtered and transformed outputs should go through the second stage: %v", outputs)
+	}
+
+	res, _ = http.Get(pipelineURL)
+	json.NewDecoder(res.Body).Decode(&pipeline)
+	if pipeline.State != "allOutputReceived" || pipeline.Inputs != 5 {
+		t.Fatalf("pipeline status should roll up its stages: %+v", pipeline)
+	}
+}
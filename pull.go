@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// defaultVisibilityTimeout is how long a leased input is hidden from other workers by default
+const defaultVisibilityTimeout = 30 * time.Second
+
+// maxLeases is the max number of inputs leased at once by a worker
+const maxLeases = 1000
+
+// leaseCheckInterval is how often expired leases are redelivered
+var leaseCheckInterval = time.Second
+
+// pullJSON makes a pull job: it has no webhook, workers lease its inputs with
+// POST /job/{id}/lease, then ack or nack them
+type pullJSON struct {
+	VisibilityTimeout string `json:"visibilityTimeout"` // how long a worker has to ack an input, like "5m"
+}
+
+// pullStatus counts the inputs leased by workers
+type pullStatus struct {
+	Leased int `json:"leased"`
+}
+
+// lease is an input leased by a worker
+type lease struct {
+	input   Input
+	expires time.Time
+}
+
+// leaseJSON is an input leased by a worker, sent by POST /job/{id}/lease
+type leaseJSON struct {
+	Lease    string      `json:"lease"`
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Encoding string      `json:"encoding,omitempty"`
+	Expires  time.Time   `json:"expires"`
+}
+
+// leases holds the inputs leased by workers, by lease ID
+type leases struct {
+	sync.Mutex
+	visibility time.Duration
+	max        int  // max number of leased inputs, 0 for no limit
+	closed     bool // the job stopped, leases were sent back to the queue
+	byID       map[string]*lease
+}
+
+func newLeases(options *pullJSON, concurrency int) (*leases, error) {
+	visibility := defaultVisibilityTimeout
+	if options.VisibilityTimeout != "" {
+		var err error
+		if visibility, err = time.ParseDuration(options.VisibilityTimeout); err != nil || visibility <= 0 {
+			return nil, fmt.Errorf("Invalid visibility timeout %q", options.VisibilityTimeout)
+		}
+	}
+	return &leases{visibility: visibility, max: concurrency, byID: make(map[string]*lease)}, nil
+}
+
+// count returns the number of leased inputs
+func (all *leases) count() int {
+	all.Lock()
+	defer all.Unlock()
+	return len(all.byID)
+}
+
+// leaseInputs leases up to count queued inputs, it doesn't wait for inputs
+func (job *Job) leaseInputs(count int) []leaseJSON {
+	all := job.leases
+	all.Lock()
+	defer all.Unlock()
+	if all.max > 0 && count > all.max-len(all.byID) {
+		count = all.max - len(all.byID)
+	}
+	result := []leaseJSON{}
+	for len(result) < count && !all.closed {
+		input, ok := job.queue.tryPop()
+		if !ok {
+			break
+		}
+		job.tenant.inputsDequeued(1)
+		id := uuid.NewV4().String()
+		each := &lease{input: input, expires: time.Now().Add(all.visibility)}
+		all.byID[id] = each
+		value, encoding := encodeValue(input.Value, "")
+		result = append(result, leaseJSON{Lease: id, Key: input.Key, Value: value, Encoding: encoding, Expires: each.expires.UTC()})
+	}
+	return result
+}
+
+// ack gives the output of a leased input, returns false if the lease is unknown or expired.
+// The lock is held while replying, so outputs can't be sent once the job stopped
+func (job *Job) ack(id string, output Output) bool {
+	all := job.leases
+	all.Lock()
+	defer all.Unlock()
+	each, ok := all.byID[id]
+	if !ok {
+		return false
+	}
+	delete(all.byID, id)
+	output.Key = each.input.Key
+	job.reply(output)
+	return true
+}
+
+// nack gives a leased input back, it's retried like inputs rejected by a webhook.
+// Returns false if the lease is unknown or expired
+func (job *Job) nack(id string) bool {
+	all := job.leases
+	all.Lock()
+	defer all.Unlock()
+	each, ok := all.byID[id]
+	if !ok {
+		return false
+	}
+	delete(all.byID, id)
+	input := each.input
+	job.log(levelWarn, "worker rejected input", "key", input.Key, "attempt", input.retryCount+1)
+	if input.retryCount < job.maxRetries {
+		input.retryCount++
+		job.requeue(input)
+	} else {
+		job.reply(Output{Key: input.Key, Error: &OutputError{Message: "Rejected by worker"}})
+	}
+	return true
+}
+
+// startLeaseReaper sends expired leases back to the queue until all inputs got an output.
+// It replaces the workers of pull jobs: when the job stops, leased inputs are sent
+// back to the queue to be checkpointed
+func (job *Job) startLeaseReaper() {
+	defer job.wg.Done()
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			job.expireLeases(time.Now())
+		case <-job.queue.done:
+			return
+		case <-job.quit:
+			all := job.leases
+			all.Lock()
+			all.closed = true
+			for id, each := range all.byID {
+				delete(all.byID, id)
+				job.requeue(each.input)
+			}
+			all.Unlock()
+			return
+		}
+	}
+}
+
+// expireLeases sends the inputs leased before now back to the queue, to be redelivered,
+// or gives them an output error once they can't be retried anymore
+func (job *Job) expireLeases(now time.Time) {
+	all := job.leases
+	all.Lock()
+	defer all.Unlock()
+	for id, each := range all.byID {
+		if now.After(each.expires) {
+			delete(all.byID, id)
+			input := each.input
+			job.log(levelWarn, "lease expired", "key", input.Key, "attempt", input.retryCount+1)
+			if input.retryCount < job.maxRetries {
+				input.retryCount++
+				job.requeue(input)
+			} else {
+				job.reply(Output{Key: input.Key, Error: &OutputError{Message: "Lease expired"}})
+			}
+		}
+	}
+}
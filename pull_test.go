@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pullRequest posts to a route of a pull job and decodes the reply
+func pullRequest(t *testing.T, url string, body string, reply interface{}) {
+	res, err := http.Post(url, "application/json", bytes.NewReader([]byte(body)))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s should succeed (%v)", url, err)
+	}
+	defer res.Body.Close()
+	json.NewDecoder(res.Body).Decode(reply)
+}
+
+func TestPull(t *testing.T) {
+	defer func(interval time.Duration) { leaseCheckInterval = interval }(leaseCheckInterval)
+	leaseCheckInterval = 10 * time.Millisecond
+
+	spec := `{"secret":"` + Secret + `","maxsize":10,"maxRetries":1,"pull":{"visibilityTimeout":"100ms"}}`
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(spec)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("pull job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	jobURL := "http://localhost:8080/job/" + job.ID
+	job.AddInputsToJob([]Input{{Key: "a", Value: []byte(`1`)}, {Key: "b", Value: []byte(`2`)}, {Key: "c", Value: []byte(`3`)}})
+	job.AllInputsWereSent()
+
+	var leased []leaseJSON
+	pullRequest(t, jobURL+"/lease?n=2", "", &leased)
+	if len(leased) != 2 || leased[0].Key != "a" || leased[0].Value != 1.0 {
+		t.Fatalf("2 inputs should be leased: %+v", leased)
+	}
+	var acked struct{ Unknown []string }
+	pullRequest(t, jobURL+"/ack", `[{"lease":"`+leased[0].Lease+`","value":{"double":2}},{"lease":"unknown"}]`, &acked)
+	if len(acked.Unknown) != 1 || acked.Unknown[0] != "unknown" {
+		t.Fatalf("unknown leases should be listed: %+v", acked)
+	}
+	pullRequest(t, jobURL+"/nack", `[{"lease":"`+leased[1].Lease+`"}]`, &acked)
+
+	// b is retried, c isn't acked in time
+	pullRequest(t, jobURL+"/lease?n=10", "", &leased)
+	if len(leased) != 2 || leased[0].Key != "c" || leased[1].Key != "b" {
+		t.Fatalf("c and b should be leased: %+v", leased)
+	}
+	pullRequest(t, jobURL+"/ack", `[{"lease":"`+leased[1].Lease+`","error":"failed again"}]`, &acked)
+	time.Sleep(200 * time.Millisecond)
+	pullRequest(t, jobURL+"/ack", `[{"lease":"`+leased[0].Lease+`","value":6}]`, &acked)
+	if len(acked.Unknown) != 1 {
+		t.Fatal("expired leases should be unknown")
+	}
+	pullRequest(t, jobURL+"/lease?n=10", "", &leased)
+	if len(leased) != 1 || leased[0].Key != "c" {
+		t.Fatalf("expired leases should be redelivered: %+v", leased)
+	}
+	pullRequest(t, jobURL+"/ack", `[{"lease":"`+leased[0].Lease+`","value":6}]`, &acked)
+
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete")
+	}
+	for key, expected := range map[string]string{"a": `{"double":2}`, "c": `6`} {
+		if output, _ := job.GetOutput(key); output == nil || string(output.Value) != expected {
+			t.Fatalf("output of %s should be %s: %+v", key, expected, output)
+		}
+	}
+	if output, _ := job.GetOutput("b"); output == nil || output.Error == nil || output.Error.Message != "failed again" {
+		t.Fatalf("output of b should be an error: %+v", output)
+	}
+}
+
+// TestLeaseRetries tests that inputs whose leases keep expiring end up with an output error
+func TestLeaseRetries(t *testing.T) {
+	defer func(interval time.Duration) { leaseCheckInterval = interval }(leaseCheckInterval)
+	leaseCheckInterval = 10 * time.Millisecond
+
+	spec := `{"secret":"` + Secret + `","maxsize":10,"maxRetries":1,"pull":{"visibilityTimeout":"50ms"}}`
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(spec)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("pull job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	defer Manager.delJob(job.ID)
+	jobURL := "http://localhost:8080/job/" + job.ID
+	job.AddInputsToJob([]Input{{Key: "a", Value: []byte(`1`)}})
+	job.AllInputsWereSent()
+
+	var leased []leaseJSON
+	for attempt := 0; attempt < 2; attempt++ {
+		pullRequest(t, jobURL+"/lease?n=1", "", &leased)
+		if len(leased) != 1 {
+			t.Fatalf("a should be leased again on attempt %d: %+v", attempt+1, leased)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should complete once a can't be retried anymore")
+	}
+	if output, _ := job.GetOutput("a"); output == nil || output.Error == nil || output.Error.Message != "Lease expired" {
+		t.Fatalf("output of a should be an error: %+v", output)
+	}
+}
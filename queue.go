@@ -0,0 +1,189 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// queuedInput is an input in the queue, seq keeps inputs of the same priority in order
+type queuedInput struct {
+	input Input
+	seq   uint64
+}
+
+// queuedInputs is a heap of inputs, highest priority first, then oldest first
+type queuedInputs []queuedInput
+
+func (items queuedInputs) Len() int { return len(items) }
+
+func (items queuedInputs) Less(i, j int) bool {
+	if items[i].input.Priority != items[j].input.Priority {
+		return items[i].input.Priority > items[j].input.Priority
+	}
+	return items[i].seq < items[j].seq
+}
+
+func (items queuedInputs) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items *queuedInputs) Push(item interface{}) { *items = append(*items, item.(queuedInput)) }
+
+func (items *queuedInputs) Pop() interface{} {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = queuedInput{}
+	*items = old[:len(old)-1]
+	return item
+}
+
+// inputQueue holds the inputs of a job waiting for a worker, workers get the highest
+// priority first. Inputs sent by clients wait while it's full, but retries and inputs
+// spawned by the webhook always go in, as workers can't wait for themselves
+type inputQueue struct {
+	sync.Mutex
+	items    queuedInputs
+	seq      uint64        // counts inputs pushed
+	capacity int           // max number of queued inputs for clients
+	closed   bool          // no more inputs, workers exit once it's empty
+	changed  chan struct{} // closed and replaced on each change, to wake up waiters
+	done     chan struct{} // closed with the queue
+}
+
+func newInputQueue(capacity int) *inputQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &inputQueue{capacity: capacity, changed: make(chan struct{}), done: make(chan struct{})}
+}
+
+// notify wakes up waiters, must be called with the lock held
+func (queue *inputQueue) notify() {
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+}
+
+// push adds an input, waiting while the queue is full unless force is true.
+// Returns false if quit was closed first
+func (queue *inputQueue) push(input Input, force bool, quit <-chan struct{}) bool {
+	queue.Lock()
+	for !force && len(queue.items) >= queue.capacity {
+		changed := queue.changed
+		queue.Unlock()
+		select {
+		case <-changed:
+		case <-quit:
+			return false
+		}
+		queue.Lock()
+	}
+	queue.seq++
+	heap.Push(&queue.items, queuedInput{input, queue.seq})
+	queue.notify()
+	queue.Unlock()
+	return true
+}
+
+// pop returns the next input, waiting until there's one.
+// Returns false once the queue is closed and empty, or if quit was closed first
+func (queue *inputQueue) pop(quit <-chan struct{}) (Input, bool) {
+	queue.Lock()
+	for len(queue.items) == 0 {
+		if queue.closed {
+			queue.Unlock()
+			return Input{}, false
+		}
+		changed := queue.changed
+		queue.Unlock()
+		select {
+		case <-changed:
+		case <-quit:
+			return Input{}, false
+		}
+		queue.Lock()
+	}
+	input := queue.shift()
+	queue.Unlock()
+	return input, true
+}
+
+// popBatch returns up to max inputs: it waits for the first one like pop, then up to wait
+// for the others. Returns nil once the queue is closed and empty, or if quit was closed first
+func (queue *inputQueue) popBatch(max int, wait time.Duration, quit <-chan struct{}) []Input {
+	first, ok := queue.pop(quit)
+	if !ok {
+		return nil
+	}
+	batch := []Input{first}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	queue.Lock()
+	for len(batch) < max {
+		if len(queue.items) > 0 {
+			batch = append(batch, queue.shift())
+			continue
+		}
+		if queue.closed {
+			break
+		}
+		changed := queue.changed
+		queue.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return batch
+		case <-quit:
+			return batch
+		}
+		queue.Lock()
+	}
+	queue.Unlock()
+	return batch
+}
+
+// tryPop returns the next input without waiting, false if there's none
+func (queue *inputQueue) tryPop() (Input, bool) {
+	queue.Lock()
+	defer queue.Unlock()
+	if len(queue.items) == 0 {
+		return Input{}, false
+	}
+	return queue.shift(), true
+}
+
+// shift removes and returns the next input, must be called with the lock held
+func (queue *inputQueue) shift() Input {
+	item := heap.Pop(&queue.items).(queuedInput)
+	queue.notify()
+	return item.input
+}
+
+// close tells workers there won't be more inputs
+func (queue *inputQueue) close() {
+	queue.Lock()
+	defer queue.Unlock()
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+	close(queue.done)
+	queue.notify()
+}
+
+// len returns the number of queued inputs
+func (queue *inputQueue) len() int {
+	queue.Lock()
+	defer queue.Unlock()
+	return len(queue.items)
+}
+
+// drain removes and returns all queued inputs, in order
+func (queue *inputQueue) drain() []Input {
+	queue.Lock()
+	defer queue.Unlock()
+	var inputs []Input
+	for len(queue.items) > 0 {
+		inputs = append(inputs, heap.Pop(&queue.items).(queuedInput).input)
+	}
+	queue.notify()
+	return inputs
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueuePriorities(t *testing.T) {
+	queue := newInputQueue(10)
+	for _, input := range []Input{{Key: "a"}, {Key: "b"}, {Key: "urgent", Priority: 10}, {Key: "c"}, {Key: "later", Priority: -1}, {Key: "urgent2", Priority: 10}} {
+		queue.push(input, false, nil)
+	}
+	first, _ := queue.pop(nil)
+	keys := []string{first.Key}
+	for _, input := range queue.drain() {
+		keys = append(keys, input.Key)
+	}
+	if order := strings.Join(keys, ","); order != "urgent,urgent2,a,b,c,later" {
+		t.Fatalf("inputs should be sent by priority, then in order: %s", order)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chrisDeFouRire/pmmap/signature"
+)
+
+// reduce modes
+const (
+	reduceBatches = "batches" // batches are folded one after the other
+	reduceTree    = "tree"    // batches are reduced concurrently, then partial results are reduced
+)
+
+// reduce states, shown in the job JSON
+const (
+	reducePending = "pending"
+	reduceRunning = "running"
+	reduceDone    = "done"
+	reduceFailed  = "failed"
+)
+
+// resultKey stores the reduced value in the outputs storage
+const resultKey = "result\x00"
+
+// reduceJSON declares the reduce webhook of a job
+type reduceJSON struct {
+	URL         string `json:"url"`         // the reduce webhook
+	Mode        string `json:"mode"`        // batches (default) or tree
+	BatchSize   int    `json:"batchSize"`   // max number of outputs or partial results per call, 100 by default
+	Concurrency int    `json:"concurrency"` // max number of concurrent calls in tree mode, 1 by default
+}
+
+// reduceStatus tells how the reduction is going
+type reduceStatus struct {
+	Mode  string `json:"mode"`
+	State string `json:"state"`
+	Calls int    `json:"calls"` // counts reduce webhook calls, retries included
+	Error string `json:"error,omitempty"`
+}
+
+// reducer calls the reduce webhook of a job once all outputs are received
+type reducer struct {
+	options reduceJSON
+	lock    sync.Mutex
+	status  reduceStatus
+}
+
+// newReducer checks the reduce options of a job
+func newReducer(options *reduceJSON) (*reducer, error) {
+	if err := checkURL("Reduce", options.URL); err != nil {
+		return nil, err
+	}
+	result := &reducer{options: *options}
+	switch options.Mode {
+	case "":
+		result.options.Mode = reduceBatches
+	case reduceBatches, reduceTree:
+	default:
+		return nil, fmt.Errorf("Unknown reduce mode %q, use batches or tree", options.Mode)
+	}
+	if options.BatchSize <= 0 {
+		result.options.BatchSize = 100
+	}
+	if options.Concurrency <= 0 {
+		result.options.Concurrency = 1
+	}
+	if result.options.Mode == reduceTree && result.options.BatchSize < 2 {
+		return nil, fmt.Errorf("Tree reductions need batches of at least 2")
+	}
+	result.status = reduceStatus{Mode: result.options.Mode, State: reducePending}
+	return result, nil
+}
+
+// getStatus returns a copy of the reduce status
+func (reducer *reducer) getStatus() reduceStatus {
+	reducer.lock.Lock()
+	defer reducer.lock.Unlock()
+	return reducer.status
+}
+
+func (reducer *reducer) setStatus(update func(status *reduceStatus)) {
+	reducer.lock.Lock()
+	defer reducer.lock.Unlock()
+	update(&reducer.status)
+}
+
+// reduceBody is sent to the reduce webhook. Batches get outputs, and the accumulator in
+// batches mode. Higher levels of a tree get the partial results of the level below
+type reduceBody struct {
+	Accumulator *json.RawMessage  `json:"accumulator,omitempty"`
+	Outputs     []kvJSON          `json:"outputs,omitempty"`
+	Partials    []json.RawMessage `json:"partials,omitempty"`
+}
+
+// runReduce reduces the outputs of a complete job, and stores the reduced value
+func (job *Job) runReduce() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-job.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	job.reducer.setStatus(func(status *reduceStatus) { status.State = reduceRunning })
+	var result json.RawMessage
+	var err error
+	if job.reducer.options.Mode == reduceTree {
+		result, err = job.reduceTree(ctx)
+	} else {
+		result, err = job.reduceBatches(ctx)
+	}
+	if err == nil {
+		err = job.store([]byte(resultKey), result)
+	}
+	if err != nil {
+		job.log(levelError, "reduce failed", "error", err)
+		job.reducer.setStatus(func(status *reduceStatus) {
+			status.State = reduceFailed
+			status.Error = err.Error()
+		})
+		return
+	}
+	job.log(levelInfo, "outputs reduced", "calls", job.reducer.getStatus().Calls)
+	job.reducer.setStatus(func(status *reduceStatus) {
+		status.State = reduceDone
+		status.Error = ""
+	})
+}
+
+// eachBatch calls fn with outputs in batches of the reduce batch size
+func (job *Job) eachBatch(fn func(batch []kvJSON) error) error {
+	batch := make([]kvJSON, 0, job.reducer.options.BatchSize)
+	err := job.EachOutput(func(output *Output) error {
+		batch = append(batch, outputJSON(output))
+		if len(batch) < job.reducer.options.BatchSize {
+			return nil
+		}
+		err := fn(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	return fn(batch)
+}
+
+// reduceBatches folds batches of outputs one after the other, the accumulator starts as null
+func (job *Job) reduceBatches(ctx context.Context) (json.RawMessage, error) {
+	accumulator := json.RawMessage("null")
+	number := 0
+	err := job.eachBatch(func(batch []kvJSON) error {
+		result, err := job.callReduce(ctx, reduceBody{Accumulator: &accumulator, Outputs: batch}, 0, number)
+		accumulator = result
+		number++
+		return err
+	})
+	return accumulator, err
+}
+
+// treeReduction holds the partial results of a tree reduction waiting to be reduced, by level.
+// A level is reduced as soon as it has a batch of partial results, so memory is bounded
+// by the concurrency and the number of levels, not by the number of outputs
+type treeReduction struct {
+	sync.Mutex
+	job      *Job
+	partials [][]json.RawMessage // partial results waiting, by level
+	batches  []int               // counts calls, by level
+}
+
+// add adds a partial result to a level, and returns a full batch of this level to reduce, or nil
+func (tree *treeReduction) add(level int, partial json.RawMessage) []json.RawMessage {
+	tree.Lock()
+	defer tree.Unlock()
+	for len(tree.partials) <= level {
+		tree.partials = append(tree.partials, nil)
+	}
+	tree.partials[level] = append(tree.partials[level], partial)
+	if len(tree.partials[level]) < tree.job.reducer.options.BatchSize {
+		return nil
+	}
+	batch := tree.partials[level]
+	tree.partials[level] = nil
+	return batch
+}
+
+// number returns the number of the next call of a level
+func (tree *treeReduction) number(level int) int {
+	tree.Lock()
+	defer tree.Unlock()
+	for len(tree.batches) <= level {
+		tree.batches = append(tree.batches, 0)
+	}
+	tree.batches[level]++
+	return tree.batches[level] - 1
+}
+
+// call reduces a body of a level, and the batches of the levels above it fills
+func (tree *treeReduction) call(ctx context.Context, body reduceBody, level int) error {
+	for {
+		partial, err := tree.job.callReduce(ctx, body, level, tree.number(level))
+		if err != nil {
+			return err
+		}
+		level++
+		batch := tree.add(level, partial)
+		if batch == nil {
+			return nil
+		}
+		body = reduceBody{Partials: batch}
+	}
+}
+
+// reduceTree reduces batches of outputs concurrently as they're read, then batches of their partial
+// results, and so on until there's a single value. It's null without outputs
+func (job *Job) reduceTree(parent context.Context) (json.RawMessage, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	tree := &treeReduction{job: job}
+	bodies := make(chan reduceBody)
+	errs := make(chan error, job.reducer.options.Concurrency)
+	var wg sync.WaitGroup
+	for worker := 0; worker < job.reducer.options.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range bodies {
+				if err := tree.call(ctx, body, 0); err != nil {
+					errs <- err // a worker fails once, errs has room for all of them
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	err := job.eachBatch(func(batch []kvJSON) error {
+		select {
+		case bodies <- reduceBody{Outputs: append([]kvJSON(nil), batch...)}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(bodies)
+	wg.Wait()
+	select {
+	case failure := <-errs: // the call which failed, rather than the cancelled reading
+		return nil, failure
+	default:
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// reduce what's left of each level with the result of the levels below
+	var result json.RawMessage
+	for level, partials := range tree.partials {
+		if result != nil {
+			partials = append(partials, result)
+		}
+		switch len(partials) {
+		case 0:
+		case 1:
+			result = partials[0]
+		default:
+			if result, err = job.callReduce(ctx, reduceBody{Partials: partials}, level, tree.number(level)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if result == nil {
+		return json.RawMessage("null"), nil
+	}
+	return result, nil
+}
+
+// callReduce POSTs a body to the reduce webhook, signed like webhook calls, with the job retries.
+// The reply must be 2xx, with JSON
+func (job *Job) callReduce(ctx context.Context, body reduceBody, level int, batch int) (json.RawMessage, error) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var result json.RawMessage
+	err = withRetries(ctx, job.maxRetries, func() error {
+		job.reducer.setStatus(func(status *reduceStatus) { status.Calls++ })
+		req, err := http.NewRequest("POST", job.reducer.options.URL, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("PMMAP-job", job.ID)
+		req.Header.Set("PMMAP-reduce-level", strconv.Itoa(level))
+		req.Header.Set("PMMAP-reduce-batch", strconv.Itoa(batch))
+		signature.SignRequest(req, job.secretKey, content, time.Now())
+		if !Scheduler.acquire(job, ctx.Done()) {
+			return ctx.Err()
+		}
+		res, err := job.client.Do(req)
+		Scheduler.release(job)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		reply, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("Reduce webhook replied %s", res.Status)
+		}
+		if !json.Valid(reply) {
+			return fmt.Errorf("Reduce webhook replied with invalid JSON")
+		}
+		result = reply
+		return nil
+	}, func(attempt int, err error) {
+		job.reducer.setStatus(func(status *reduceStatus) { status.Error = err.Error() })
+		job.log(levelWarn, "reduce call failed", "level", level, "batch", batch, "attempt", attempt, "error", err)
+	})
+	return result, err
+}
+
+// GetReduced returns the reduced value, nil until the reduction is done
+func (job *Job) GetReduced() (json.RawMessage, error) {
+	value, err := job.outputsDB.Get([]byte(resultKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(value), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestReduce sums outputs with a reduce webhook, in both modes
+func TestReduce(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	reduce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Accumulator *int
+			Outputs     []struct{ Value int }
+			Partials    []int
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		sum := 0
+		if body.Accumulator != nil {
+			sum = *body.Accumulator
+		}
+		for _, output := range body.Outputs {
+			sum += output.Value
+		}
+		for _, partial := range body.Partials {
+			sum += partial
+		}
+		w.Write([]byte(strconv.Itoa(sum)))
+	}))
+	defer reduce.Close()
+
+	for _, test := range []struct {
+		mode  string
+		calls int
+	}{
+		{reduceBatches, 3}, // 2+2+1 outputs
+		{reduceTree, 5},    // 2+2+1 outputs, then 2 partials (the third one is kept), then 2 partials
+	} {
+		u, _ := url.Parse(backend.URL)
+		job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.reducer, err = newReducer(&reduceJSON{URL: reduce.URL, Mode: test.mode, BatchSize: 2, Concurrency: 2}); err != nil {
+			t.Fatal(err)
+		}
+		job.Start(2)
+		for value := 1; value <= 5; value++ {
+			job.AddToJob("key"+strconv.Itoa(value), []byte(strconv.Itoa(value)))
+		}
+		job.AllInputsWereSent()
+		<-job.done
+
+		result, err := job.GetReduced()
+		if err != nil || string(result) != "15" {
+			t.Fatalf("%s reduction should be 15, not %s (%v)", test.mode, result, err)
+		}
+		if status := job.reducer.getStatus(); status.State != reduceDone || status.Calls != test.calls {
+			t.Fatalf("%s reduction status isn't right: %+v", test.mode, status)
+		}
+	}
+}
+
+// TestReduceTreeStreaming tests that partial results are reduced while outputs are still read
+func TestReduceTreeStreaming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	var lock sync.Mutex
+	var levels []string
+	reduce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Outputs  []struct{ Value int }
+			Partials []int
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		lock.Lock()
+		levels = append(levels, req.Header.Get("PMMAP-reduce-level"))
+		lock.Unlock()
+		sum := 0
+		for _, output := range body.Outputs {
+			sum += output.Value
+		}
+		for _, partial := range body.Partials {
+			sum += partial
+		}
+		w.Write([]byte(strconv.Itoa(sum)))
+	}))
+	defer reduce.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.reducer, err = newReducer(&reduceJSON{URL: reduce.URL, Mode: reduceTree, BatchSize: 2, Concurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	job.Start(2)
+	for value := 1; value <= 20; value++ {
+		job.AddToJob("key"+strconv.Itoa(value), []byte(strconv.Itoa(value)))
+	}
+	job.AllInputsWereSent()
+	<-job.done
+
+	if result, err := job.GetReduced(); err != nil || string(result) != "210" {
+		t.Fatalf("tree reduction should be 210, not %s (%v)", result, err)
+	}
+	last := strings.LastIndex(strings.Join(levels, ""), "0")
+	if first := strings.Index(strings.Join(levels, ""), "1"); first < 0 || first > last || len(levels) != 19 {
+		t.Fatalf("partial results should be reduced while outputs are read, in 19 calls: %v", levels)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// storage keys of the description of a job, and of its state when it was stopped,
+// so it can be restored when PMmap restarts
+const (
+	specKey    = "spec\x00"
+	stoppedKey = "stopped\x00"
+)
+
+// jobSpec is the description of a job, as created
+type jobSpec struct {
+	Tenant string        `json:"tenant"`
+	Job    createJobJSON `json:"job"`
+}
+
+// stoppedJob is the state of a job when it was stopped
+type stoppedJob struct {
+	State   int64         `json:"state"`
+	Failure string        `json:"failure,omitempty"`
+	Reduce  *reduceStatus `json:"reduce,omitempty"`
+	Sink    *sinkStatus   `json:"sink,omitempty"`
+}
+
+// saveSpec stores the description of the job with its outputs
+func (job *Job) saveSpec(query *createJobJSON) error {
+	b, err := json.Marshal(&jobSpec{job.tenant.ID, *query})
+	if err != nil {
+		return err
+	}
+	return job.outputsDB.Put([]byte(specKey), b, nil)
+}
+
+// saveStopped stores the state of the job once its workers are stopped
+func (job *Job) saveStopped() error {
+	stopped := stoppedJob{State: atomic.LoadInt64(&job.State)}
+	stopped.Failure, _ = job.failure.Load().(string)
+	if job.reducer != nil {
+		status := job.reducer.getStatus()
+		stopped.Reduce = &status
+	}
+	if job.sink != nil {
+		status := job.sink.getStatus()
+		stopped.Sink = &status
+	}
+	b, err := json.Marshal(&stopped)
+	if err != nil {
+		return err
+	}
+	return job.outputsDB.Put([]byte(stoppedKey), b, nil)
+}
+
+// restoreJobs restores the jobs of a previous run of the server. Jobs which can't be
+// restored are logged and left on disk
+func restoreJobs() error {
+	dirs, err := ioutil.ReadDir(filepath.Join(config.DataDir, "job"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if err := restoreJob(dir.Name()); err != nil {
+			logEvent(levelWarn, "can't restore job", "job", dir.Name(), "error", err)
+		}
+	}
+	return nil
+}
+
+// restoreJob starts a job again from its description. Its outputs are kept, unfinished jobs
+// get their checkpointed inputs back, complete and failed jobs stay as they were
+func restoreJob(id string) error {
+	var spec jobSpec
+	var stopped *stoppedJob // nil if the server didn't stop cleanly
+	if err := readStored(id, &spec, &stopped); err != nil {
+		return err
+	}
+	tenant := Tenants.getTenant(spec.Tenant)
+	if tenant == nil {
+		return fmt.Errorf("Unknown tenant %s", spec.Tenant)
+	}
+	inputs, err := readCheckpoint(id)
+	if err != nil {
+		return err
+	}
+	job, err := buildJob(tenant, &spec.Job, id)
+	if err != nil {
+		return err
+	}
+	if err := job.countStored(); err != nil {
+		job.log(levelWarn, "can't count stored outputs", "error", err)
+	}
+
+	state := int64(ReceivingInputs)
+	if stopped != nil {
+		state = stopped.State
+		if job.reducer != nil && stopped.Reduce != nil {
+			job.reducer.setStatus(func(status *reduceStatus) { *status = *stopped.Reduce })
+		}
+		if job.sink != nil && stopped.Sink != nil {
+			job.sink.setStatus(func(status *sinkStatus) { *status = *stopped.Sink })
+		}
+	}
+	switch state {
+	case ErrorState:
+		job.failure.Store(stopped.Failure)
+		atomic.StoreInt64(&job.State, ErrorState)
+		job.stopOnce.Do(func() { close(job.quit) })
+	case AllOutputReceived:
+		job.AllInputsWereSent()
+		<-job.done // it has no input to wait for
+	default:
+		job.restoreInputs(inputs)
+		if state == AllInputReceived {
+			job.AllInputsWereSent()
+		}
+	}
+	os.Remove(filepath.Join(config.DataDir, "checkpoint", id+".json"))
+	job.log(levelInfo, "job restored", "state", stateNames[atomic.LoadInt64(&job.State)], "inputs", len(inputs))
+	return nil
+}
+
+// readStored reads the description and the stopped state of a job from its outputs storage
+func readStored(id string, spec *jobSpec, stopped **stoppedJob) error {
+	db, err := leveldb.OpenFile(filepath.Join(config.DataDir, "job", id), nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	b, err := db.Get([]byte(specKey), nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("Job has no description")
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, spec); err != nil {
+		return err
+	}
+	b, err = db.Get([]byte(stoppedKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, stopped)
+}
+
+// readCheckpoint reads the inputs checkpointed when a job was stopped, nil if there are none
+func readCheckpoint(id string) ([]Input, error) {
+	b, err := ioutil.ReadFile(filepath.Join(config.DataDir, "checkpoint", id+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var checkpointed []inputJSON
+	if err := json.Unmarshal(b, &checkpointed); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint: %v", err)
+	}
+	inputs := make([]Input, len(checkpointed))
+	for index, each := range checkpointed {
+		value, err := decodeValue(each.Value, each.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid checkpoint value for %s: %v", each.Key, err)
+		}
+		inputs[index] = Input{Key: each.Key, Value: value, Priority: each.Priority}
+	}
+	return inputs, nil
+}
+
+// countStored counts the outputs and the disk usage of a restored job, and adds
+// its outputs to its aggregates. Each output counts as an input which was sent
+func (job *Job) countStored() error {
+	iter := job.outputsDB.NewIterator(nil, nil)
+	defer iter.Release()
+	var outputs, size int64
+	for iter.Next() {
+		key := string(iter.Key())
+		if key == specKey || key == stoppedKey {
+			continue
+		}
+		size += int64(len(iter.Key()) + len(iter.Value()))
+		if !strings.HasPrefix(key, outputPrefix) {
+			continue
+		}
+		outputs++
+		if job.aggregates != nil {
+			output, err := decodeOutput(key[len(outputPrefix):], iter.Value())
+			if err != nil {
+				return err
+			}
+			job.aggregates.add(output)
+		}
+	}
+	atomic.StoreInt64(&job.outputsCount, outputs)
+	atomic.StoreInt64(&job.inputsCount, outputs)
+	atomic.StoreInt64(&job.diskUsage, size)
+	job.tenant.addDiskUsage(size)
+	return iter.Error()
+}
+
+// restoreInputs queues checkpointed inputs again. Like retries, they don't wait for room
+// in the queue and aren't checked against the quotas of the tenant: they were accepted already
+func (job *Job) restoreInputs(inputs []Input) {
+	if len(inputs) == 0 {
+		return
+	}
+	job.Lock()
+	job.receiving(len(inputs))
+	atomic.AddInt64(&job.pending, int64(len(inputs)))
+	job.Unlock()
+	for _, input := range inputs {
+		job.requeue(input)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// restart stops a job like a shutdown does, and restores it like the next run of the server
+func restart(t *testing.T, job *Job) *Job {
+	if err := job.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	Manager.Lock()
+	delete(Manager.jobs, job.ID)
+	Manager.Unlock()
+	job.tenant.addDiskUsage(-atomic.LoadInt64(&job.diskUsage)) // a new server starts from 0
+	if err := restoreJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	restored := Manager.getJob(job.ID)
+	if restored == nil {
+		t.Fatal("the job should be restored")
+	}
+	return restored
+}
+
+// TestRestoreJob tests that a stopped job carries on with its checkpointed inputs when it's restored,
+// and that a complete job is restored with its outputs
+func TestRestoreJob(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`"done"`))
+	}))
+	defer backend.Close()
+
+	query := `{"secret":"` + Secret + `","url":"` + backend.URL + `","maxsize":10,"concurrency":1,"aggregates":{"count":{"type":"count"}}}`
+	res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(query)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	for c := 0; c < 3; c++ {
+		job.AddToJob("key"+strconv.Itoa(c), []byte(`"value"`))
+	}
+	job.AllInputsWereSent()
+	time.Sleep(20 * time.Millisecond) // let the worker call the backend
+	go func() {
+		time.Sleep(20 * time.Millisecond) // let Stop signal the worker
+		close(release)
+	}()
+
+	job = restart(t, job)
+	defer Manager.delJob(job.ID)
+	select {
+	case <-job.Complete:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the restored job should complete with its checkpointed inputs")
+	}
+	if job.GetOutputsCount() != 3 || job.GetInputsCount() != 3 || job.GetResult("key2") == nil {
+		t.Fatalf("the restored job should have all outputs: %d inputs, %d outputs", job.GetInputsCount(), job.GetOutputsCount())
+	}
+	if count := job.aggregates.values()["count"].(map[string]int64); count["successes"] != 3 {
+		t.Fatalf("aggregates should count the outputs stored before the restart: %v", count)
+	}
+
+	job = restart(t, job)
+	if atomic.LoadInt64(&job.State) != AllOutputReceived || job.GetOutputsCount() != 3 || atomic.LoadInt64(&job.diskUsage) == 0 {
+		t.Fatalf("the complete job should be restored as it was: %s, %d outputs", stateNames[atomic.LoadInt64(&job.State)], job.GetOutputsCount())
+	}
+}
@@ -1,50 +1,327 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/chrisDeFouRire/pmmap/signature"
 	"github.com/gorilla/mux"
 )
 
 type createJobJSON struct {
-	URL         string `json:"url"`
-	Secret      string `json:"secret"`
-	Maxsize     uint   `json:"maxsize"`
-	Concurrency int    `json:"concurrency"`
+	URL         string                   `json:"url"`
+	Method      string                   `json:"method"`
+	Headers     map[string]string        `json:"headers"`
+	Body        *string                  `json:"body"`
+	ContentType string                   `json:"contentType"`
+	Secret      string                   `json:"secret"`
+	Plaintext   bool                     `json:"plaintextSecret"`
+	Maxsize     uint                     `json:"maxsize"`
+	Concurrency int                      `json:"concurrency"`
+	Timeout     string                   `json:"timeout"`
+	MaxRetries  *int                     `json:"maxRetries"`
+	Attempts    *int                     `json:"attemptsRetention"`
+	Success     []int                    `json:"successCodes"`
+	Metadata    *metadataJSON            `json:"metadata"`
+	Sink        *sinkJSON                `json:"sink"`
+	Reduce      *reduceJSON              `json:"reduce"`
+	Aggregates  map[string]aggregateJSON `json:"aggregates"`
+	FanOut      *fanOutJSON              `json:"fanOut"`
+	Async       *asyncJSON               `json:"async"`
+	Pull        *pullJSON                `json:"pull"`
+	BatchSize   int                      `json:"batchSize"`
+	BatchWait   int                      `json:"batchWait"` // in milliseconds
+	Weight      int64                    `json:"weight"`    // share of webhook calls against other jobs of the tenant, 1 by default
+	Template    string                   `json:"template"`  // the job is this template, other fields are ignored
+	Overrides   map[string]interface{}   `json:"overrides"` // fields replacing those of the template
+	TLS         *webhookTLSJSON          `json:"tls"`
+}
+
+// metadataJSON asks to store the metadata of each output, with some response headers
+type metadataJSON struct {
+	Headers []string `json:"headers"`
+}
+
+type tenantJSON struct {
+	Token           string `json:"token"`
+	MaxJobs         int64  `json:"maxJobs"`
+	MaxInflight     int64  `json:"maxInflight"`
+	MaxQueuedInputs int64  `json:"maxQueuedInputs"`
+	MaxDiskUsage    int64  `json:"maxDiskUsage"`
 }
 
 type kvJSON struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
+	Key         string          `json:"key"`
+	Value       interface{}     `json:"value"`
+	Encoding    string          `json:"encoding,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Error       *OutputError    `json:"error,omitempty"`
+	Metadata    *OutputMetadata `json:"metadata,omitempty"`
+	Priority    int             `json:"priority,omitempty"` // of checkpointed inputs
 }
 
-func createJob(w http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
-	var query createJobJSON
+// inputJSON is an input sent to PUT /job/{id}/input
+type inputJSON struct {
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value"`
+	Encoding string          `json:"encoding"` // json (default), raw or base64
+	Priority int             `json:"priority"` // inputs with a higher priority are sent first, 0 by default
+}
+
+// tenantFromRequest returns the tenant identified by the request headers,
+// or writes a 401 reply and returns nil
+func tenantFromRequest(w http.ResponseWriter, req *http.Request) *Tenant {
+	tenant, err := Tenants.identify(req.Header.Get("PMMAP-token"), req.Header.Get("PMMAP-tenant"))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return nil
+	}
+	return tenant
+}
 
-	if err := json.NewDecoder(req.Body).Decode(&query); err == nil {
-		if u, err := url.Parse(query.URL); err == nil {
+// jobFromRequest returns the job of the request if it belongs to the tenant,
+// or writes an error reply and returns nil
+func jobFromRequest(w http.ResponseWriter, req *http.Request) *Job {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return nil
+	}
+	job := Manager.getJob(mux.Vars(req)["id"])
+	if job == nil || job.tenant != tenant {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return job
+}
 
-			job := CreateJob(query.Secret, *u, query.Maxsize)
-			job.Start(query.Concurrency)
-			Manager.addJob(job)
+// errTooManyJobs is returned when the server already runs its max number of jobs
+var errTooManyJobs = errors.New("Too many jobs on this server")
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(job)
-			return
+// writeJobError replies with 429 when a quota is exceeded, 503 when the server is full,
+// 500 when the job failed, 400 otherwise
+func writeJobError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*QuotaError); ok {
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if _, ok := err.(*JobFailedError); ok {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if err == errTooManyJobs {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// webhookFromQuery checks the webhook options of a job. Pull jobs have no webhook,
+// their request and URL are empty
+func webhookFromQuery(query *createJobJSON) (*webhookRequest, *url.URL, error) {
+	if query.Pull != nil {
+		if query.URL != "" {
+			return nil, nil, fmt.Errorf("Pull jobs have no webhook url")
+		}
+		return &webhookRequest{}, &url.URL{}, nil
+	}
+	if query.Async != nil && query.Secret == "" { // anyone could send the callbacks
+		return nil, nil, fmt.Errorf("Async jobs must have a secret to sign their callbacks")
+	}
+	request, err := newWebhookRequest(query.Method, query.URL, query.Headers, query.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if query.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(query.ContentType); err != nil {
+			return nil, nil, fmt.Errorf("Invalid content type %q", query.ContentType)
 		}
+		request.contentType = query.ContentType
+	}
+	u, err := request.parsedURL("key")
+	if err != nil {
+		return nil, nil, err
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	if !config.AllowedWebhookHosts.allows(u.Hostname()) {
+		return nil, nil, fmt.Errorf("Webhook host %s is not allowed", u.Hostname())
+	}
+	return request, u, nil
+}
+
+// newJob creates and starts a job for a tenant from its JSON description
+func newJob(tenant *Tenant, query *createJobJSON) (*Job, error) {
+	return buildJob(tenant, query, "")
+}
+
+// buildJob creates and starts a job, and stores its description to restore it when PMmap restarts.
+// Restored jobs keep their id, new jobs get a new one
+func buildJob(tenant *Tenant, query *createJobJSON, id string) (*Job, error) {
+	query, err := resolveTemplate(tenant, query)
+	if err != nil {
+		return nil, err
+	}
+	request, u, err := webhookFromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	batchWait, err := checkBatches(query, request)
+	if err != nil {
+		return nil, err
+	}
+	weight := query.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	if weight < 1 || weight > maxWeight {
+		return nil, fmt.Errorf("Weight must be between 1 and %d", maxWeight)
+	}
+	if config.MaxConcurrency > 0 && query.Concurrency > config.MaxConcurrency {
+		return nil, fmt.Errorf("Concurrency can't be more than %d", config.MaxConcurrency)
+	}
+	timeout := config.JobTimeout
+	if query.Timeout != "" {
+		if timeout, err = time.ParseDuration(query.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q", query.Timeout)
+		}
+	}
+	for _, code := range query.Success {
+		if code < 200 || code > 299 {
+			return nil, fmt.Errorf("Success code %d isn't a 2xx status code", code)
+		}
+	}
+	var jobSink *outputSink
+	if query.Sink != nil {
+		if jobSink, err = newSink(query.Sink); err != nil {
+			return nil, err
+		}
+	}
+	var jobReducer *reducer
+	if query.Reduce != nil {
+		if jobReducer, err = newReducer(query.Reduce); err != nil {
+			return nil, err
+		}
+	}
+	var jobAggregates *aggregates
+	if len(query.Aggregates) > 0 {
+		if jobAggregates, err = newAggregates(query.Aggregates); err != nil {
+			return nil, err
+		}
+	}
+	var jobFanOut *fanOut
+	if query.FanOut != nil {
+		if jobFanOut, err = newFanOut(query.FanOut); err != nil {
+			return nil, err
+		}
+	}
+	var jobLeases *leases
+	if query.Pull != nil {
+		if jobLeases, err = newLeases(query.Pull, query.Concurrency); err != nil {
+			return nil, err
+		}
+	}
+	var jobAsync *asyncCalls
+	if query.Async != nil {
+		if jobAsync, err = newAsyncCalls(query.Async); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxJobs > 0 && Manager.count() >= config.MaxJobs {
+		return nil, errTooManyJobs
+	}
+	var transport *http.Transport
+	if query.TLS != nil {
+		if transport, err = query.TLS.transport(); err != nil {
+			return nil, err
+		}
+	}
+	job, err := CreateJob(tenant, query.Secret, *u, query.Maxsize)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		job.ID = id
+	}
+	job.request = request
+	if transport != nil {
+		job.client.Transport = transport
+	}
+	job.client.Timeout = timeout
+	if query.MaxRetries != nil && *query.MaxRetries >= 0 {
+		job.maxRetries = *query.MaxRetries
+	}
+	if query.Attempts != nil && *query.Attempts >= 0 {
+		job.attemptsRetention = *query.Attempts
+	}
+	if len(query.Success) > 0 {
+		job.successCodes = query.Success
+	}
+	if query.Metadata != nil {
+		job.metadata = true
+		job.keepHeaders = query.Metadata.Headers
+	}
+	job.sink = jobSink
+	job.reducer = jobReducer
+	job.aggregates = jobAggregates
+	job.fanOut = jobFanOut
+	job.async = jobAsync
+	job.leases = jobLeases
+	job.batchSize = query.BatchSize
+	job.batchWait = batchWait
+	job.weight = weight
+	job.plaintext = query.Plaintext
+	if err := job.Start(query.Concurrency); err != nil {
+		return nil, err
+	}
+	if err := job.saveSpec(query); err != nil {
+		err = job.fail(err)
+		job.Stop(context.Background())
+		os.RemoveAll(filepath.Join(config.DataDir, "job", job.ID))
+		return nil, err
+	}
+	Manager.addJob(job)
+	return job, nil
+}
+
+func createJob(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	var query createJobJSON
+
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("PMmap is shutting down"))
+		return
+	}
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	job, err := newJob(tenant, &query)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
 }
 
 func getJob(w http.ResponseWriter, req *http.Request) {
-	id := mux.Vars(req)["id"]
-	job := Manager.getJob(id)
+	job := jobFromRequest(w, req)
 	if job == nil {
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -54,37 +331,44 @@ func getJob(w http.ResponseWriter, req *http.Request) {
 
 func addInput(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	id := mux.Vars(req)["id"]
-	job := Manager.getJob(id)
+	job := jobFromRequest(w, req)
 	if job == nil {
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	var body []kvJSON
+	if addInputs(w, req, job) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// addInputs adds the inputs of a request to a job, returns false after replying with an error
+func addInputs(w http.ResponseWriter, req *http.Request, job *Job) bool {
+	var body []inputJSON
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
-		return
+		return false
 	}
 	for _, eachkv := range body {
-		bytes, _ := json.Marshal(eachkv.Value)
-		if err := job.AddToJob(eachkv.Key, bytes); err != nil {
+		bytes, err := decodeValue(eachkv.Value, eachkv.Encoding)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+			w.Write([]byte(fmt.Sprintf("Invalid value for %s: %v", eachkv.Key, err)))
+			return false
+		}
+		if err := job.AddInputsToJob([]Input{{Key: eachkv.Key, Value: bytes, Priority: eachkv.Priority}}); err != nil {
+			writeJobError(w, err)
+			return false
 		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(job)
+	return true
 }
 
 func allInputSent(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	id := mux.Vars(req)["id"]
-	job := Manager.getJob(id)
+	job := jobFromRequest(w, req)
 	if job == nil {
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	if err := job.AllInputsWereSent(); err != nil {
@@ -97,52 +381,631 @@ func allInputSent(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(job)
 }
 
-func getJobOutputs(w http.ResponseWriter, req *http.Request) {
+// addInputsFrom streams the inputs of a source into a job in the background,
+// the progress is in the ingestion of the job
+func addInputsFrom(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	id := mux.Vars(req)["id"]
-	job := Manager.getJob(id)
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	var spec ingestJSON
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ingest, err := newIngestion(spec)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := job.startIngestion(ingest); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ingest.getStatus())
+}
+
+// getIngestion returns the progress of the last ingestion of a job
+func getIngestion(w http.ResponseWriter, req *http.Request) {
+	job := jobFromRequest(w, req)
 	if job == nil {
+		return
+	}
+	ingest := job.getIngestion()
+	if ingest == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ingest.getStatus())
+}
+
+func getJobOutputs(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
 	// TODO handle optional nowait, skip, limit options
 	if job.GetInputsCount() != job.GetOutputsCount() {
 		// wait only if we haven't received all outputs
 		<-job.Complete
 	}
-	if job.State != AllOutputReceived {
+	if atomic.LoadInt64(&job.State) != AllOutputReceived {
 		w.WriteHeader(http.StatusExpectationFailed)
 		json.NewEncoder(w).Encode(job)
 		return
 	}
-	res, err := job.GetResults()
+	exportOutputs(w, req, job)
+}
 
+// getOutput returns the raw output of a key, with the content type sent by the backend
+func getOutput(w http.ResponseWriter, req *http.Request) {
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	output, err := job.GetOutput(mux.Vars(req)["key"])
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	result := make([]kvJSON, len(res))
-	for index, eachkv := range res {
-		var value interface{}
-		json.Unmarshal(eachkv.Value, &value)
-		result[index] = kvJSON{
-			Key:   eachkv.Key,
-			Value: value,
+	if output == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if output.Error != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(output.Error)
+		return
+	}
+	if output.ContentType != "" {
+		w.Header().Set("Content-Type", output.ContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(output.Value)
+}
+
+// ackJSON is the output of a leased input, sent by a worker to POST /job/{id}/ack.
+// Only the lease is needed by POST /job/{id}/nack
+type ackJSON struct {
+	Lease       string          `json:"lease"`
+	Value       json.RawMessage `json:"value"`
+	Encoding    string          `json:"encoding"`
+	ContentType string          `json:"contentType"`
+	Error       string          `json:"error"` // the input failed, it gets an output error
+}
+
+// pullJobFromRequest returns the pull job of the request, or writes an error reply and returns nil
+func pullJobFromRequest(w http.ResponseWriter, req *http.Request) *Job {
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return nil
+	}
+	if job.leases == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Job isn't a pull job"))
+		return nil
+	}
+	return job
+}
+
+// leaseInputs gives up to n queued inputs to a worker, they're redelivered if they aren't acked in time
+func leaseInputs(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	job := pullJobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	count := 1
+	if param := req.URL.Query().Get("n"); param != "" {
+		var err error
+		if count, err = strconv.Atoi(param); err != nil || count < 1 || count > maxLeases {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("n must be between 1 and %d", maxLeases)))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job.leaseInputs(count))
+}
+
+// ackInputs receives the outputs of leased inputs, or gives them back with nack.
+// It replies the leases which are unknown, most likely because they expired
+func ackInputs(nack bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		job := pullJobFromRequest(w, req)
+		if job == nil {
+			return
+		}
+		var body []ackJSON
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		outputs := make([]Output, len(body))
+		for index, each := range body {
+			if nack {
+				continue
+			}
+			if each.Error != "" {
+				outputs[index].Error = &OutputError{Message: each.Error}
+				continue
+			}
+			value, err := decodeValue(each.Value, each.Encoding)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid value for lease %s: %v", each.Lease, err)))
+				return
+			}
+			outputs[index] = Output{Value: value, ContentType: each.ContentType}
+			if len(value) == 0 {
+				outputs[index].Value = nil
+			}
+		}
+		unknown := []string{}
+		for index, each := range body {
+			var found bool
+			if nack {
+				found = job.nack(each.Lease)
+			} else {
+				found = job.ack(each.Lease, outputs[index])
+			}
+			if !found {
+				unknown = append(unknown, each.Lease)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string][]string{"unknown": unknown})
+	}
+}
+
+// callbackMaxSkew is how far the timestamp of a callback can be from now
+const callbackMaxSkew = 5 * time.Minute
+
+// postOutput receives the reply of an async webhook call. Callbacks are signed with the
+// job secret like webhook calls, the PMMAP-status header tells the webhook status code (200 by default)
+func postOutput(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	job := Manager.getJob(mux.Vars(req)["id"])
+	if job == nil || job.async == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := signature.Verify(req, job.secretKey, callbackMaxSkew); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	status := http.StatusOK
+	if header := req.Header.Get("PMMAP-status"); header != "" {
+		if status, err = strconv.Atoi(header); err != nil || status < 200 || status > 599 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid PMMAP-status %q", header)))
+			return
+		}
+	}
+	reply := &callback{response: &http.Response{StatusCode: status, Header: req.Header}, body: body}
+	if !job.async.deliver(mux.Vars(req)["key"], reply) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No input is waiting for this callback"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// getReduced returns the reduced value of a job, or its reduce status until it's done
+func getReduced(w http.ResponseWriter, req *http.Request) {
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	if job.reducer == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Job has no reduce webhook"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch status := job.reducer.getStatus(); status.State {
+	case reduceDone:
+		value, err := job.GetReduced()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(status)
+			return
 		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(value)
+	case reduceFailed:
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// getAggregates returns the current values of the built-in aggregates of a job
+func getAggregates(w http.ResponseWriter, req *http.Request) {
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	if job.aggregates == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Job has no aggregates"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job.aggregates.values())
+}
+
+func getAttempts(w http.ResponseWriter, req *http.Request) {
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	attempts, err := job.GetAttempts(mux.Vars(req)["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(attempts)
 }
 
 func deleteJob(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	id := mux.Vars(req)["id"]
-	Manager.delJob(id)
-	// TODO this will leak if the job isn't finished yet
+	job := jobFromRequest(w, req)
+	if job == nil {
+		return
+	}
+	Manager.delJob(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+func setTemplate(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	var query templateJSON
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := Templates.setTemplate(tenant, &query); err != nil {
+		if _, ok := err.(*StateError); ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&templateJSON{query.Name, redactTemplate(Templates.getTemplate(tenant, query.Name))})
+}
+
+func listTemplates(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Templates.names(tenant))
+}
+
+// getTemplate returns a template without its secrets
+func getTemplate(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	job := Templates.getTemplate(tenant, name)
+	if job == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&templateJSON{name, redactTemplate(job)})
+}
+
+func deleteTemplate(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	if !Templates.delTemplate(tenant, mux.Vars(req)["name"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// scheduleFromRequest returns the schedule of the request, or replies 404 if the tenant has none of this name
+func scheduleFromRequest(w http.ResponseWriter, req *http.Request) *Schedule {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return nil
+	}
+	schedule := Schedules.getSchedule(tenant, mux.Vars(req)["name"])
+	if schedule == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return schedule
+}
+
+func createSchedule(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	var query scheduleJSON
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	schedule, err := newSchedule(tenant, &query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !Schedules.addSchedule(schedule) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("Schedule %s already exists", query.Name)))
+		return
+	}
+	schedule.Lock()
+	schedule.start()
+	schedule.Unlock()
+	if err := Schedules.save(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func listSchedules(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Schedules.list(tenant))
+}
+
+func getSchedule(w http.ResponseWriter, req *http.Request) {
+	schedule := scheduleFromRequest(w, req)
+	if schedule == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// pauseSchedule pauses or resumes a schedule
+func pauseSchedule(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		schedule := scheduleFromRequest(w, req)
+		if schedule == nil {
+			return
+		}
+		schedule.pause(paused)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(schedule)
+	}
+}
+
+// triggerSchedule creates a job of the schedule now, even if it's paused
+func triggerSchedule(w http.ResponseWriter, req *http.Request) {
+	schedule := scheduleFromRequest(w, req)
+	if schedule == nil {
+		return
+	}
+	job, err := schedule.trigger()
+	if err == errShuttingDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+func deleteSchedule(w http.ResponseWriter, req *http.Request) {
+	schedule := scheduleFromRequest(w, req)
+	if schedule == nil {
+		return
+	}
+	schedule.delete()
+	w.WriteHeader(http.StatusOK)
+}
+
+// pipelineFromRequest returns the pipeline of the request, or replies 404 if it's not there or owned by another tenant
+func pipelineFromRequest(w http.ResponseWriter, req *http.Request) *Pipeline {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return nil
+	}
+	pipeline := Pipelines.getPipeline(mux.Vars(req)["id"])
+	if pipeline == nil || pipeline.tenant != tenant {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return pipeline
+}
+
+func createPipeline(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("PMmap is shutting down"))
+		return
+	}
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	var query pipelineJSON
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	pipeline, err := newPipeline(tenant, &query)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pipeline)
+}
+
+func getPipeline(w http.ResponseWriter, req *http.Request) {
+	pipeline := pipelineFromRequest(w, req)
+	if pipeline == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pipeline)
+}
+
+// addPipelineInput adds inputs to the first stage of a pipeline
+func addPipelineInput(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	pipeline := pipelineFromRequest(w, req)
+	if pipeline == nil {
+		return
+	}
+	if addInputs(w, req, pipeline.first()) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pipeline)
+	}
+}
+
+// completePipeline tells the first stage of a pipeline it has received all inputs, next stages follow
+func completePipeline(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	pipeline := pipelineFromRequest(w, req)
+	if pipeline == nil {
+		return
+	}
+	if err := pipeline.first().AllInputsWereSent(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pipeline)
+}
+
+func deletePipeline(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	pipeline := pipelineFromRequest(w, req)
+	if pipeline == nil {
+		return
+	}
+	pipeline.delete()
+	w.WriteHeader(http.StatusOK)
+}
+
+// isAdmin tells if the request has the admin token of the server, there's no admin without token
+func isAdmin(req *http.Request) bool {
+	token := req.Header.Get("PMMAP-admin-token")
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+func setTenant(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !isAdmin(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Declaring tenants requires the admin token"))
+		return
+	}
+	var query tenantJSON
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	tenant, err := Tenants.setTenant(mux.Vars(req)["id"], query.Token, Tenant{
+		MaxJobs:         query.MaxJobs,
+		MaxInflight:     query.MaxInflight,
+		MaxQueuedInputs: query.MaxQueuedInputs,
+		MaxDiskUsage:    query.MaxDiskUsage,
+	})
+	if err != nil {
+		logEvent(levelError, "can't save tenants", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("The tenant is set, but it can't be saved"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tenant)
+}
+
+func getTenantUsage(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(w, req)
+	if tenant == nil {
+		return
+	}
+	if tenant.ID != mux.Vars(req)["id"] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tenant)
 }
 
 func routes() *mux.Router {
@@ -151,9 +1014,40 @@ func routes() *mux.Router {
 	routes.HandleFunc("/job", createJob).Methods("POST")
 	routes.HandleFunc("/job/{id}", getJob).Methods("GET")
 	routes.HandleFunc("/job/{id}/output", getJobOutputs).Methods("GET")
+	routes.HandleFunc("/job/{id}/output/{key:.+}", getOutput).Methods("GET")
+	routes.HandleFunc("/job/{id}/output/{key:.+}", postOutput).Methods("POST")
 	routes.HandleFunc("/job/{id}/input", addInput).Methods("PUT")
+	routes.HandleFunc("/job/{id}/input/from", addInputsFrom).Methods("POST")
+	routes.HandleFunc("/job/{id}/input/from", getIngestion).Methods("GET")
+	routes.HandleFunc("/job/{id}/input/{key:.+}/attempts", getAttempts).Methods("GET")
 	routes.HandleFunc("/job/{id}/complete", allInputSent).Methods("POST")
+	routes.HandleFunc("/job/{id}/lease", leaseInputs).Methods("POST")
+	routes.HandleFunc("/job/{id}/ack", ackInputs(false)).Methods("POST")
+	routes.HandleFunc("/job/{id}/nack", ackInputs(true)).Methods("POST")
+	routes.HandleFunc("/job/{id}/result", getReduced).Methods("GET")
+	routes.HandleFunc("/job/{id}/aggregates", getAggregates).Methods("GET")
 	routes.HandleFunc("/job/{id}", deleteJob).Methods("DELETE")
+	routes.HandleFunc("/pipeline", createPipeline).Methods("POST")
+	routes.HandleFunc("/pipeline/{id}", getPipeline).Methods("GET")
+	routes.HandleFunc("/pipeline/{id}/input", addPipelineInput).Methods("PUT")
+	routes.HandleFunc("/pipeline/{id}/complete", completePipeline).Methods("POST")
+	routes.HandleFunc("/pipeline/{id}", deletePipeline).Methods("DELETE")
+	routes.HandleFunc("/template", setTemplate).Methods("POST")
+	routes.HandleFunc("/template", listTemplates).Methods("GET")
+	routes.HandleFunc("/template/{name}", getTemplate).Methods("GET")
+	routes.HandleFunc("/template/{name}", deleteTemplate).Methods("DELETE")
+	routes.HandleFunc("/schedule", createSchedule).Methods("POST")
+	routes.HandleFunc("/schedule", listSchedules).Methods("GET")
+	routes.HandleFunc("/schedule/{name}", getSchedule).Methods("GET")
+	routes.HandleFunc("/schedule/{name}", deleteSchedule).Methods("DELETE")
+	routes.HandleFunc("/schedule/{name}/pause", pauseSchedule(true)).Methods("POST")
+	routes.HandleFunc("/schedule/{name}/resume", pauseSchedule(false)).Methods("POST")
+	routes.HandleFunc("/schedule/{name}/trigger", triggerSchedule).Methods("POST")
+	routes.HandleFunc("/tenant/{id}", setTenant).Methods("PUT")
+	routes.HandleFunc("/tenant/{id}/usage", getTenantUsage).Methods("GET")
+	routes.HandleFunc("/healthz", healthz).Methods("GET")
+	routes.HandleFunc("/readyz", readyz).Methods("GET")
+	routes.HandleFunc("/debug/status", debugStatus).Methods("GET")
 	return routes
 
 	// TODO need a route to get more status information
@@ -3,12 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/chrisDeFouRire/pmmap/signature"
 	"github.com/gorilla/mux"
 )
 
@@ -20,8 +22,16 @@ const (
 
 // TestMain is run for every tests. It starts the PMmap server and a dummy test backend
 func TestMain(m *testing.M) {
-	// run the PMmap server
-	go main()
+	// run the PMmap server with the default configuration, and a data directory of its own
+	dir, err := ioutil.TempDir("", "pmmap")
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.DataDir = dir
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	go serve()
 
 	// start a dummy test backend
 	go func() {
@@ -37,8 +47,11 @@ func TestMain(m *testing.M) {
 			if req.Header.Get("Content-Type") != "application/json" {
 				log.Fatal("Backend should be called with application/json content type instead of ", req.Header.Get("Content-Type"))
 			}
-			if req.Header.Get("PMMAP-auth") != Secret {
-				log.Fatalf("Incorrect secret key %s vs. %s", req.Header.Get("PMMAP-auth"), Secret)
+			if req.Header.Get("PMMAP-auth") != "" {
+				log.Fatal("Secret key should not be sent in plaintext")
+			}
+			if err := signature.Verify(req, Secret, time.Minute); err != nil {
+				log.Fatal("Incorrect signature ", err)
 			}
 			if mux.Vars(req)["key"][0:5] != "hello" {
 				log.Fatalf("Incorrect key")
@@ -54,7 +67,9 @@ func TestMain(m *testing.M) {
 	}()
 
 	time.Sleep(time.Millisecond * 50)
-	os.Exit(m.Run())
+	status := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(status)
 }
 
 func TestIntegration(t *testing.T) {
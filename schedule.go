@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetainedRuns is the number of runs of a schedule kept by default
+const defaultRetainedRuns = 10
+
+// errShuttingDown is returned when a job can't be created because the server is stopping
+var errShuttingDown = errors.New("PMmap is shutting down")
+
+// scheduleJSON declares a job created at each trigger of a cron expression
+type scheduleJSON struct {
+	Name      string        `json:"name"`
+	Cron      string        `json:"cron"` // like "0 2 * * *" or @daily, in the server time zone
+	Job       createJobJSON `json:"job"`
+	Source    sourceJSON    `json:"source"`
+	Retention retentionJSON `json:"retention"`
+}
+
+// sourceJSON tells where the inputs of each run come from
+type sourceJSON struct {
+	Inputs  []inputJSON       `json:"inputs"`  // a stored list of inputs
+	URL     string            `json:"url"`     // or an HTTP endpoint replying inputs as NDJSON
+	Headers map[string]string `json:"headers"` // headers sent to url
+}
+
+// retentionJSON tells which past runs are kept, others are deleted with their outputs
+type retentionJSON struct {
+	Runs   int    `json:"runs"`   // number of runs kept, 10 by default
+	MaxAge string `json:"maxAge"` // runs older than this are deleted, like "168h"
+}
+
+// scheduleRun is a job created by a schedule
+type scheduleRun struct {
+	job     *Job
+	started time.Time
+}
+
+// Schedule creates a job at each trigger of its cron expression
+type Schedule struct {
+	sync.Mutex
+	spec      scheduleJSON
+	tenant    *Tenant
+	cron      *cronSchedule
+	maxAge    time.Duration // 0 to keep runs whatever their age
+	paused    bool
+	deleted   bool
+	runs      []scheduleRun // oldest first
+	next      time.Time
+	lastError string
+	timer     *time.Timer
+}
+
+// scheduleManager holds schedules, by tenant and name
+type scheduleManager struct {
+	sync.RWMutex
+	schedules map[string]*Schedule
+	saving    sync.Mutex // so the last state saved is the last one
+}
+
+// Schedules is the entry point to schedules
+var Schedules = scheduleManager{schedules: make(map[string]*Schedule)}
+
+func scheduleID(tenant *Tenant, name string) string {
+	return tenant.ID + "\x00" + name
+}
+
+// addSchedule adds a schedule, returns false if the tenant has one with the same name
+func (man *scheduleManager) addSchedule(schedule *Schedule) bool {
+	man.Lock()
+	defer man.Unlock()
+	id := scheduleID(schedule.tenant, schedule.spec.Name)
+	if _, found := man.schedules[id]; found {
+		return false
+	}
+	man.schedules[id] = schedule
+	return true
+}
+
+func (man *scheduleManager) getSchedule(tenant *Tenant, name string) *Schedule {
+	man.RLock()
+	defer man.RUnlock()
+	return man.schedules[scheduleID(tenant, name)]
+}
+
+func (man *scheduleManager) delSchedule(schedule *Schedule) {
+	man.Lock()
+	defer man.Unlock()
+	delete(man.schedules, scheduleID(schedule.tenant, schedule.spec.Name))
+}
+
+// list returns the schedules of a tenant, by name
+func (man *scheduleManager) list(tenant *Tenant) []*Schedule {
+	man.RLock()
+	defer man.RUnlock()
+	result := []*Schedule{}
+	for _, schedule := range man.schedules {
+		if schedule.tenant == tenant {
+			result = append(result, schedule)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].spec.Name < result[j].spec.Name })
+	return result
+}
+
+// newSchedule checks a schedule, it's armed by start
+func newSchedule(tenant *Tenant, spec *scheduleJSON) (*Schedule, error) {
+	if spec.Name == "" || strings.Contains(spec.Name, "/") {
+		return nil, fmt.Errorf("Schedule name can't be empty or contain /")
+	}
+	cron, err := parseCron(spec.Cron)
+	if err != nil {
+		return nil, err
+	}
+	query, err := resolveTemplate(tenant, &spec.Job)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := webhookFromQuery(query); err != nil {
+		return nil, err
+	}
+	if spec.Source.URL != "" {
+		if len(spec.Source.Inputs) > 0 {
+			return nil, fmt.Errorf("Source can't have both inputs and url")
+		}
+		if err := checkSourceURL(spec.Source.URL); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Retention.Runs < 0 {
+		return nil, fmt.Errorf("Retention runs can't be negative")
+	}
+	if spec.Retention.Runs == 0 {
+		spec.Retention.Runs = defaultRetainedRuns
+	}
+	schedule := &Schedule{spec: *spec, tenant: tenant, cron: cron}
+	if spec.Retention.MaxAge != "" {
+		if schedule.maxAge, err = time.ParseDuration(spec.Retention.MaxAge); err != nil || schedule.maxAge <= 0 {
+			return nil, fmt.Errorf("Invalid retention maxAge %q", spec.Retention.MaxAge)
+		}
+	}
+	return schedule, nil
+}
+
+// start arms the timer of the next trigger, must be called with the lock held
+func (schedule *Schedule) start() {
+	if schedule.paused || schedule.deleted {
+		return
+	}
+	schedule.next = schedule.cron.next(time.Now())
+	if schedule.next.IsZero() {
+		schedule.lastError = "The cron expression never triggers"
+		return
+	}
+	schedule.timer = time.AfterFunc(time.Until(schedule.next), schedule.fire)
+}
+
+// stop disarms the timer, must be called with the lock held
+func (schedule *Schedule) stop() {
+	if schedule.timer != nil {
+		schedule.timer.Stop()
+		schedule.timer = nil
+	}
+	schedule.next = time.Time{}
+}
+
+// fire runs the schedule, then arms the next trigger
+func (schedule *Schedule) fire() {
+	if _, err := schedule.trigger(); err != nil {
+		logEvent(levelWarn, "scheduled job not created", "schedule", schedule.spec.Name, "tenant", schedule.tenant.ID, "error", err)
+	}
+	schedule.Lock()
+	defer schedule.Unlock()
+	schedule.start()
+}
+
+// pause disarms the schedule, resume arms it again
+func (schedule *Schedule) pause(paused bool) {
+	schedule.Lock()
+	schedule.paused = paused
+	schedule.stop()
+	schedule.start()
+	schedule.Unlock()
+	Schedules.saveOrLog()
+}
+
+// delete disarms the schedule, its runs are kept
+func (schedule *Schedule) delete() {
+	schedule.Lock()
+	schedule.deleted = true
+	schedule.stop()
+	Schedules.delSchedule(schedule)
+	schedule.Unlock()
+	Schedules.saveOrLog()
+}
+
+// trigger creates a job now, and feeds it the inputs of the source in the background.
+// Runs beyond the retention policy are deleted
+func (schedule *Schedule) trigger() (*Job, error) {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return nil, errShuttingDown
+	}
+	spec := schedule.spec.Job
+	job, err := newJob(schedule.tenant, &spec)
+
+	schedule.Lock()
+	if err != nil {
+		schedule.lastError = err.Error()
+		schedule.Unlock()
+		return nil, err
+	}
+	schedule.lastError = ""
+	now := time.Now()
+	schedule.runs = append(schedule.runs, scheduleRun{job, now})
+	kept := schedule.runs[:0]
+	for index, run := range schedule.runs {
+		expired := schedule.maxAge > 0 && now.Sub(run.started) > schedule.maxAge
+		if index < len(schedule.runs)-schedule.spec.Retention.Runs || (expired && run.job != job) {
+			go Manager.delJob(run.job.ID)
+			continue
+		}
+		kept = append(kept, run)
+	}
+	schedule.runs = kept
+	schedule.Unlock()
+	Schedules.saveOrLog()
+	logEvent(levelInfo, "scheduled job created", "schedule", schedule.spec.Name, "tenant", schedule.tenant.ID, "job", job.ID)
+	go schedule.feed(job)
+	return job, nil
+}
+
+// feed sends the inputs of the source to a job, then tells it all inputs were sent
+func (schedule *Schedule) feed(job *Job) {
+	err := schedule.sendSource(job)
+	if err != nil {
+		job.log(levelWarn, "can't read schedule source", "schedule", schedule.spec.Name, "error", err)
+		schedule.Lock()
+		schedule.lastError = err.Error()
+		schedule.Unlock()
+	}
+	job.AllInputsWereSent()
+}
+
+// sendSource sends the inputs of the source to a job, waiting while its queue is full
+func (schedule *Schedule) sendSource(job *Job) error {
+	source := schedule.spec.Source
+	if source.URL == "" {
+		for _, each := range source.Inputs {
+			if err := addInputJSON(job, &each); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	res, err := fetchSource(source.URL, source.Headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return readNDJSON(res.Body, func(each *inputJSON) error { return addInputJSON(job, each) })
+}
+
+// savedSchedule is a schedule as saved in the state directory, with the ids of its runs
+type savedSchedule struct {
+	Tenant string       `json:"tenant"`
+	Spec   scheduleJSON `json:"spec"`
+	Paused bool         `json:"paused"`
+	Error  string       `json:"error,omitempty"`
+	Runs   []savedRun   `json:"runs"`
+}
+
+type savedRun struct {
+	Job     string    `json:"job"`
+	Started time.Time `json:"started"`
+}
+
+// schedulesState is the name of the saved schedules in the state directory
+const schedulesState = "schedules"
+
+// save writes all schedules with their runs. It must be called without holding
+// the lock of a schedule
+func (man *scheduleManager) save() error {
+	man.saving.Lock()
+	defer man.saving.Unlock()
+	man.RLock()
+	schedules := make([]*Schedule, 0, len(man.schedules))
+	for _, schedule := range man.schedules {
+		schedules = append(schedules, schedule)
+	}
+	man.RUnlock()
+
+	saved := make([]savedSchedule, 0, len(schedules))
+	for _, schedule := range schedules {
+		schedule.Lock()
+		if !schedule.deleted {
+			each := savedSchedule{schedule.tenant.ID, schedule.spec, schedule.paused, schedule.lastError, make([]savedRun, len(schedule.runs))}
+			for index, run := range schedule.runs {
+				each.Runs[index] = savedRun{run.job.ID, run.started}
+			}
+			saved = append(saved, each)
+		}
+		schedule.Unlock()
+	}
+	return saveState(schedulesState, saved)
+}
+
+// saveOrLog saves the schedules, and logs why it can't
+func (man *scheduleManager) saveOrLog() {
+	if err := man.save(); err != nil {
+		logEvent(levelError, "can't save schedules", "error", err)
+	}
+}
+
+// load arms the schedules saved by a previous run of the server again, with their runs
+// which were restored. Schedules which can't be loaded are logged and dropped
+func (man *scheduleManager) load() error {
+	var saved []savedSchedule
+	if err := loadState(schedulesState, &saved); err != nil {
+		return err
+	}
+	for _, each := range saved {
+		tenant := Tenants.getTenant(each.Tenant)
+		if tenant == nil {
+			logEvent(levelWarn, "can't restore schedule", "schedule", each.Spec.Name, "tenant", each.Tenant, "error", "unknown tenant")
+			continue
+		}
+		schedule, err := newSchedule(tenant, &each.Spec)
+		if err != nil {
+			logEvent(levelWarn, "can't restore schedule", "schedule", each.Spec.Name, "tenant", each.Tenant, "error", err)
+			continue
+		}
+		schedule.paused = each.Paused
+		schedule.lastError = each.Error
+		for _, run := range each.Runs {
+			if job := Manager.getJob(run.Job); job != nil {
+				schedule.runs = append(schedule.runs, scheduleRun{job, run.Started})
+			}
+		}
+		if !man.addSchedule(schedule) {
+			continue
+		}
+		schedule.Lock()
+		schedule.start()
+		schedule.Unlock()
+	}
+	return nil
+}
+
+// MarshalJSON gives a JSON representation of a Schedule, with its runs
+func (schedule *Schedule) MarshalJSON() ([]byte, error) {
+	schedule.Lock()
+	defer schedule.Unlock()
+	type runJSON struct {
+		Job     string    `json:"job"`
+		Started time.Time `json:"started"`
+		State   string    `json:"state"`
+	}
+	runs := make([]runJSON, len(schedule.runs))
+	for index, run := range schedule.runs {
+		runs[index] = runJSON{run.job.ID, run.started.UTC(), stateNames[atomic.LoadInt64(&run.job.State)]}
+	}
+	var next *time.Time
+	if !schedule.next.IsZero() {
+		utc := schedule.next.UTC()
+		next = &utc
+	}
+	return json.Marshal(&struct {
+		Name      string        `json:"name"`
+		Cron      string        `json:"cron"`
+		Paused    bool          `json:"paused"`
+		Next      *time.Time    `json:"next,omitempty"`
+		Retention retentionJSON `json:"retention"`
+		Error     string        `json:"error,omitempty"`
+		Runs      []runJSON     `json:"runs"`
+	}{schedule.spec.Name, schedule.spec.Cron, schedule.paused, next, schedule.spec.Retention, schedule.lastError, runs})
+}
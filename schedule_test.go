@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	from := time.Date(2020, 1, 31, 22, 47, 30, 0, time.UTC) // a friday
+	for expression, expected := range map[string]string{
+		"*/15 * * * *":   "2020-01-31 23:00",
+		"30 2 * * *":     "2020-02-01 02:30",
+		"@daily":         "2020-02-01 00:00",
+		"0 9 * * 1-5":    "2020-02-03 09:00",
+		"0 0 29 2 *":     "2020-02-29 00:00",
+		"0 0 13 * 5":     "2020-02-07 00:00", // the 13th or fridays
+		"0 0 */2 * 1":    "2020-02-03 00:00", // odd days which are mondays
+		"0 0 13 * */6":   "2020-06-13 00:00", // the 13th if it's a sunday or saturday
+		"5,10 22-23 * *": "",                 // 4 fields
+		"0 0 30 2 *":     "",
+	} {
+		cron, err := parseCron(expression)
+		if expected == "" {
+			if err == nil && !cron.next(from).IsZero() {
+				t.Fatalf("%s should be invalid or never trigger", expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := cron.next(from).Format("2006-01-02 15:04"); next != expected {
+			t.Fatalf("%s should trigger at %s, not %s", expression, expected, next)
+		}
+	}
+	for _, expression := range []string{"60 * * * *", "* * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expression); err == nil {
+			t.Fatalf("%s should be invalid", expression)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{\"key\":\"a\",\"value\":1}\n\n{\"key\":\"b\",\"value\":2}\n"))
+	}))
+	defer source.Close()
+
+	spec, _ := json.Marshal(map[string]interface{}{
+		"name":      "nightly",
+		"cron":      "0 3 * * *",
+		"job":       map[string]interface{}{"secret": Secret, "url": "http://localhost:7777/test", "maxsize": 10, "concurrency": 1},
+		"source":    map[string]interface{}{"url": source.URL},
+		"retention": map[string]interface{}{"runs": 1},
+	})
+	res, err := http.Post("http://localhost:8080/schedule", "application/json", bytes.NewReader(spec))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("schedule should be created (%v)", err)
+	}
+	if res, _ := http.Post("http://localhost:8080/schedule", "application/json", bytes.NewReader(spec)); res.StatusCode != http.StatusConflict {
+		t.Fatal("schedule names should be unique")
+	}
+	defer func() {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/schedule/nightly", nil)
+		http.DefaultClient.Do(req)
+	}()
+
+	var runs []string
+	for run := 0; run < 2; run++ {
+		res, err := http.Post("http://localhost:8080/schedule/nightly/trigger", "application/json", nil)
+		if err != nil || res.StatusCode != http.StatusCreated {
+			t.Fatalf("schedule should be triggered (%v)", err)
+		}
+		var created struct{ ID string }
+		json.NewDecoder(res.Body).Decode(&created)
+		job := Manager.getJob(created.ID)
+		select {
+		case <-job.Complete:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the scheduled job should complete")
+		}
+		if job.GetOutputsCount() != 2 {
+			t.Fatalf("the inputs of the source should be sent, not %d", job.GetOutputsCount())
+		}
+		runs = append(runs, job.ID)
+	}
+	if Manager.getJob(runs[0]) != nil {
+		t.Fatal("runs beyond the retention should be deleted")
+	}
+
+	res, _ = http.Post("http://localhost:8080/schedule/nightly/pause", "application/json", nil)
+	var schedule struct {
+		Paused bool
+		Next   *time.Time
+		Runs   []struct{ Job string }
+	}
+	json.NewDecoder(res.Body).Decode(&schedule)
+	if !schedule.Paused || schedule.Next != nil || len(schedule.Runs) != 1 || schedule.Runs[0].Job != runs[1] {
+		t.Fatalf("schedule should be paused with the last run: %+v", schedule)
+	}
+	restored := scheduleManager{schedules: make(map[string]*Schedule)}
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	saved := restored.getSchedule(Tenants.tenants[DefaultTenantID], "nightly")
+	if saved == nil || !saved.paused || len(saved.runs) != 1 || saved.runs[0].job.ID != runs[1] {
+		t.Fatalf("schedule should be restored paused with its last run: %+v", saved)
+	}
+	res, _ = http.Post("http://localhost:8080/schedule/nightly/resume", "application/json", nil)
+	json.NewDecoder(res.Body).Decode(&schedule)
+	if schedule.Paused || schedule.Next == nil || schedule.Next.Local().Hour() != 3 {
+		t.Fatalf("schedule should be resumed: %+v", schedule)
+	}
+}
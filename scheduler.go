@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxWeight is the max weight of a job
+const maxWeight = 1000
+
+// slotRequest is a worker waiting for the right to call a webhook
+type slotRequest struct {
+	job   *Job
+	ready chan struct{} // closed when the slot is granted
+}
+
+// scheduler grants webhook call slots to workers, maxInflight is the budget of the server.
+// When slots are scarce, they're granted to the waiting tenant with the
+// fewest calls in flight, so a big batch can't starve other tenants.
+// Between jobs of a tenant, they're granted to the job with the fewest calls
+// in flight for its weight, so a job of weight 2 gets twice as many slots
+type scheduler struct {
+	sync.Mutex
+	inflight int64
+	waiting  []*slotRequest
+}
+
+// Scheduler is the server-wide scheduler of webhook calls
+var Scheduler = &scheduler{}
+
+// acquire blocks until the job is allowed one more webhook call.
+// Returns false without slot if quit is closed first, like when the job stops
+func (sched *scheduler) acquire(job *Job, quit <-chan struct{}) bool {
+	request := &slotRequest{job: job, ready: make(chan struct{})}
+	sched.Lock()
+	sched.waiting = append(sched.waiting, request)
+	sched.dispatch()
+	sched.Unlock()
+	select {
+	case <-request.ready:
+		return true
+	case <-quit:
+	}
+	sched.Lock()
+	for index, each := range sched.waiting {
+		if each == request {
+			sched.waiting = append(sched.waiting[:index], sched.waiting[index+1:]...)
+			sched.Unlock()
+			return false
+		}
+	}
+	sched.Unlock()
+	sched.release(job) // granted meanwhile, it goes to another job
+	return false
+}
+
+// release gives back a slot obtained with acquire
+func (sched *scheduler) release(job *Job) {
+	sched.Lock()
+	defer sched.Unlock()
+	sched.inflight--
+	atomic.AddInt64(&job.tenant.inflight, -1)
+	atomic.AddInt64(&job.inflight, -1)
+	sched.dispatch()
+}
+
+// dispatch grants as many slots as possible, must be called with the lock held
+func (sched *scheduler) dispatch() {
+	for len(sched.waiting) > 0 {
+		if max := atomic.LoadInt64(&config.MaxInflight); max > 0 && sched.inflight >= max {
+			return
+		}
+		chosen := -1
+		for index, request := range sched.waiting {
+			tenant := request.job.tenant
+			if max := atomic.LoadInt64(&tenant.MaxInflight); max > 0 && atomic.LoadInt64(&tenant.inflight) >= max {
+				continue // this tenant must wait for one of its own calls to finish
+			}
+			if chosen == -1 || request.before(sched.waiting[chosen]) {
+				chosen = index
+			}
+		}
+		if chosen == -1 {
+			return
+		}
+		request := sched.waiting[chosen]
+		sched.waiting = append(sched.waiting[:chosen], sched.waiting[chosen+1:]...)
+		sched.inflight++
+		atomic.AddInt64(&request.job.tenant.inflight, 1)
+		atomic.AddInt64(&request.job.inflight, 1)
+		close(request.ready)
+	}
+}
+
+// before tells if a request should get a slot before another one, which waits for longer:
+// its tenant has fewer calls in flight, or it's the same tenant and its job has fewer calls in flight for its weight
+func (request *slotRequest) before(other *slotRequest) bool {
+	inflight, otherInflight := atomic.LoadInt64(&request.job.tenant.inflight), atomic.LoadInt64(&other.job.tenant.inflight)
+	if inflight != otherInflight || request.job.tenant != other.job.tenant {
+		return inflight < otherInflight
+	}
+	return atomic.LoadInt64(&request.job.inflight)*other.job.weight < atomic.LoadInt64(&other.job.inflight)*request.job.weight
+}
+
+// count returns the number of webhook calls in flight
+func (sched *scheduler) count() int64 {
+	sched.Lock()
+	defer sched.Unlock()
+	return sched.inflight
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSchedulerFairness tests that a free slot goes to the tenant with the fewest calls in flight
+func TestSchedulerFairness(t *testing.T) {
+	sched := &scheduler{}
+	atomic.StoreInt64(&config.MaxInflight, 2)
+	defer atomic.StoreInt64(&config.MaxInflight, 0)
+
+	big, small := &Job{tenant: &Tenant{ID: "big"}, weight: 1}, &Job{tenant: &Tenant{ID: "small"}, weight: 1}
+	sched.acquire(big, nil)
+	sched.acquire(big, nil)
+
+	granted := make(chan string, 3)
+	for _, job := range []*Job{big, big, small} {
+		go func(job *Job) {
+			sched.acquire(job, nil)
+			granted <- job.tenant.ID
+		}(job)
+		time.Sleep(5 * time.Millisecond) // keep the waiting order
+	}
+	sched.release(big)
+	if id := <-granted; id != "small" {
+		t.Fatalf("the slot should have been granted to the small tenant, not %s", id)
+	}
+}
+
+// TestSchedulerWeights tests that jobs of a tenant get slots according to their weight
+func TestSchedulerWeights(t *testing.T) {
+	sched := &scheduler{}
+	atomic.StoreInt64(&config.MaxInflight, 3)
+	defer atomic.StoreInt64(&config.MaxInflight, 0)
+
+	tenant := &Tenant{ID: "weighted"}
+	heavy, light, other := &Job{ID: "heavy", tenant: tenant, weight: 2}, &Job{ID: "light", tenant: tenant, weight: 1}, &Job{ID: "other", tenant: tenant, weight: 1}
+	for _, job := range []*Job{heavy, light, other} {
+		sched.acquire(job, nil)
+	}
+
+	granted := make(chan string, 2)
+	for _, job := range []*Job{light, heavy} {
+		go func(job *Job) {
+			sched.acquire(job, nil)
+			granted <- job.ID
+		}(job)
+		time.Sleep(5 * time.Millisecond) // keep the waiting order
+	}
+	sched.release(other)
+	if id := <-granted; id != "heavy" {
+		t.Fatalf("the slot should have been granted to the heavy job, not %s", id)
+	}
+
+	for _, weight := range []int64{-1, maxWeight + 1} {
+		b, _ := json.Marshal(createJobJSON{URL: "http://" + localServerAddress + webhook, Secret: Secret, Maxsize: 1, Weight: weight})
+		if res, err := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader(b)); err != nil || res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("weight %d should be rejected", weight)
+		}
+	}
+}
+
+// TestSchedulerQuit tests that a stopped job stops waiting for a slot, and leaves it to others
+func TestSchedulerQuit(t *testing.T) {
+	sched := &scheduler{}
+	atomic.StoreInt64(&config.MaxInflight, 1)
+	defer atomic.StoreInt64(&config.MaxInflight, 0)
+
+	tenant := &Tenant{ID: "quit"}
+	running, stopped := &Job{tenant: tenant, weight: 1}, &Job{tenant: tenant, weight: 1}
+	sched.acquire(running, nil)
+	quit := make(chan struct{})
+	result := make(chan bool)
+	go func() { result <- sched.acquire(stopped, quit) }()
+	time.Sleep(5 * time.Millisecond)
+	close(quit)
+	if <-result {
+		t.Fatal("a stopped job shouldn't get a slot")
+	}
+	sched.release(running)
+	if !sched.acquire(running, nil) || sched.count() != 1 || atomic.LoadInt64(&stopped.inflight) != 0 {
+		t.Fatal("the slot should go to the running job")
+	}
+}
@@ -0,0 +1,91 @@
+// Package signature signs and verifies the requests PMmap sends to webhooks.
+//
+// Each request carries a PMMAP-timestamp header with the unix time of the call,
+// and a PMMAP-signature header with the hex encoded HMAC-SHA256 of the method,
+// the request URI, the timestamp and the body, keyed with the job secret.
+//
+// Webhooks written in Go can check requests with Verify:
+//
+//	if err := signature.Verify(req, secret, 5*time.Minute); err != nil {
+//		w.WriteHeader(http.StatusUnauthorized)
+//		return
+//	}
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureHeader is the header holding the signature of the request
+	SignatureHeader = "PMMAP-signature"
+
+	// TimestampHeader is the header holding the unix time of the request
+	TimestampHeader = "PMMAP-timestamp"
+)
+
+var (
+	// ErrMissingSignature is returned when the request isn't signed
+	ErrMissingSignature = errors.New("missing signature or timestamp")
+
+	// ErrExpired is returned when the request timestamp is too far from now, it may be a replay
+	ErrExpired = errors.New("request timestamp is too old or too far in the future")
+
+	// ErrBadSignature is returned when the signature doesn't match the request
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// Sign returns the signature of a request
+func Sign(secret, method, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp and signature headers of a request, body must be the request body
+func SignRequest(req *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(secret, req.Method, req.URL.RequestURI(), timestamp, body))
+}
+
+// Verify checks the signature of a request received by a webhook, and rejects it
+// if its timestamp is more than maxSkew away from now.
+// The body is read, then restored so it can be read again by the caller
+func Verify(req *http.Request, secret string, maxSkew time.Duration) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	signature := req.Header.Get(SignatureHeader)
+	if timestamp == "" || signature == "" {
+		return ErrMissingSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMissingSignature
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return ErrExpired
+	}
+
+	var body []byte
+	if req.Body != nil {
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := Sign(secret, req.Method, req.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package signature
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`"hello"`)
+	req := httptest.NewRequest("POST", "http://webhook/work/key?a=b", bytes.NewReader(body))
+	SignRequest(req, "secret", body, time.Now())
+
+	if err := Verify(req, "secret", time.Minute); err != nil {
+		t.Fatal("signed request should be verified ", err)
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != `"hello"` {
+		t.Fatalf("body should be readable after verification, got %s", string(b))
+	}
+	if err := Verify(req, "another secret", time.Minute); err != ErrBadSignature {
+		t.Fatal("wrong secret should be rejected ", err)
+	}
+}
+
+func TestVerifyTamperedAndExpired(t *testing.T) {
+	body := []byte(`"hello"`)
+	req := httptest.NewRequest("POST", "http://webhook/work/key", bytes.NewReader([]byte(`"tampered"`)))
+	SignRequest(req, "secret", body, time.Now())
+	if err := Verify(req, "secret", time.Minute); err != ErrBadSignature {
+		t.Fatal("tampered body should be rejected ", err)
+	}
+
+	req = httptest.NewRequest("POST", "http://webhook/work/key", bytes.NewReader(body))
+	SignRequest(req, "secret", body, time.Now().Add(-time.Hour))
+	if err := Verify(req, "secret", time.Minute); err != ErrExpired {
+		t.Fatal("old request should be rejected ", err)
+	}
+
+	req = httptest.NewRequest("POST", "http://webhook/work/key", bytes.NewReader(body))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	if err := Verify(req, "secret", time.Minute); err != ErrMissingSignature {
+		t.Fatal("unsigned request should be rejected ", err)
+	}
+}
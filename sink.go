@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrisDeFouRire/pmmap/signature"
+)
+
+// sink types
+const (
+	sinkHTTP = "http"
+	sinkFile = "file"
+	sinkS3   = "s3"
+)
+
+// sink states, shown in the job JSON
+const (
+	sinkPending = "pending"
+	sinkRunning = "running"
+	sinkDone    = "done"
+	sinkFailed  = "failed"
+)
+
+// jobIDPlaceholder is replaced by the job ID in sink paths and keys
+const jobIDPlaceholder = "{id}"
+
+// sinkClient pushes outputs to sinks, its timeout lets whole jobs be uploaded to S3
+var sinkClient = &http.Client{Timeout: 5 * time.Minute}
+
+// retryBackoff is the wait before the first retry of a sink or reduce call, it grows with each attempt
+var retryBackoff = time.Second
+
+// sinkJSON tells where to push the outputs of a job when it completes
+type sinkJSON struct {
+	Type       string            `json:"type"`       // http, file or s3
+	URL        string            `json:"url"`        // http: the endpoint receiving batches
+	Headers    map[string]string `json:"headers"`    // http: static headers added to each batch
+	BatchSize  int               `json:"batchSize"`  // http: max number of outputs per batch
+	Path       string            `json:"path"`       // file: the NDJSON file, in the server sink directory
+	Endpoint   string            `json:"endpoint"`   // s3: the object store URL, like https://s3.eu-west-1.amazonaws.com
+	Bucket     string            `json:"bucket"`     // s3: the bucket
+	Key        string            `json:"key"`        // s3: the object key of the NDJSON file
+	Region     string            `json:"region"`     // s3: the region, us-east-1 by default
+	AccessKey  string            `json:"accessKey"`  // s3: the access key ID
+	SecretKey  string            `json:"secretKey"`  // s3: the secret access key
+	MaxRetries *int              `json:"maxRetries"` // max number of retries of each push
+}
+
+// sinkStatus tells how the push to the sink is going
+type sinkStatus struct {
+	Type     string `json:"type"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"` // counts pushes, retries included
+	Outputs  int    `json:"outputs"`  // counts outputs pushed
+	Error    string `json:"error,omitempty"`
+}
+
+// outputSink pushes the outputs of a job
+type outputSink struct {
+	options    sinkJSON
+	maxRetries int
+	lock       sync.Mutex
+	status     sinkStatus
+}
+
+// newSink checks the sink options of a job
+func newSink(options *sinkJSON) (*outputSink, error) {
+	result := &outputSink{options: *options, maxRetries: 3, status: sinkStatus{Type: options.Type, State: sinkPending}}
+	if options.MaxRetries != nil && *options.MaxRetries >= 0 {
+		result.maxRetries = *options.MaxRetries
+	}
+	switch options.Type {
+	case sinkHTTP:
+		if err := checkURL("Sink", options.URL); err != nil {
+			return nil, err
+		}
+		if options.BatchSize <= 0 {
+			result.options.BatchSize = 1000
+		}
+	case sinkFile:
+		if config.SinkDir == "" {
+			return nil, fmt.Errorf("File sinks are disabled, the server has no sink directory")
+		}
+		if options.Path == "" {
+			return nil, fmt.Errorf("File sink needs a path")
+		}
+	case sinkS3:
+		if err := checkURL("Sink", options.Endpoint); err != nil {
+			return nil, err
+		}
+		if options.Bucket == "" || options.Key == "" || options.AccessKey == "" || options.SecretKey == "" {
+			return nil, fmt.Errorf("S3 sink needs a bucket, a key, an access key and a secret key")
+		}
+		if options.Region == "" {
+			result.options.Region = "us-east-1"
+		}
+	default:
+		return nil, fmt.Errorf("Unknown sink type %q, use http, file or s3", options.Type)
+	}
+	return result, nil
+}
+
+// checkURL checks the URL of a sink or reduce webhook, its host must be allowed like webhooks
+func checkURL(kind string, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s URL %q must be http or https", kind, rawURL)
+	}
+	if !config.AllowedWebhookHosts.allows(u.Hostname()) {
+		return fmt.Errorf("%s host %s is not allowed", kind, u.Hostname())
+	}
+	return nil
+}
+
+// getStatus returns a copy of the sink status
+func (sink *outputSink) getStatus() sinkStatus {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.status
+}
+
+func (sink *outputSink) setStatus(update func(status *sinkStatus)) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	update(&sink.status)
+}
+
+// runSink pushes the outputs of a complete job to its sink
+func (job *Job) runSink() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-job.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	job.sink.setStatus(func(status *sinkStatus) { status.State = sinkRunning })
+	var err error
+	switch job.sink.options.Type {
+	case sinkHTTP:
+		err = job.pushBatches(ctx)
+	case sinkFile:
+		err = job.withSinkRetries(ctx, func() error { return job.pushFile() })
+	case sinkS3:
+		err = job.withSinkRetries(ctx, func() error { return job.pushS3(ctx) })
+	}
+	if err != nil {
+		job.log(levelError, "sink push failed", "sink", job.sink.options.Type, "error", err)
+		job.sink.setStatus(func(status *sinkStatus) {
+			status.State = sinkFailed
+			status.Error = err.Error()
+		})
+		return
+	}
+	job.log(levelInfo, "outputs pushed to sink", "sink", job.sink.options.Type, "outputs", job.sink.getStatus().Outputs)
+	job.sink.setStatus(func(status *sinkStatus) {
+		status.State = sinkDone
+		status.Error = ""
+	})
+}
+
+// withSinkRetries calls push until it succeeds, at most 1+maxRetries times
+func (job *Job) withSinkRetries(ctx context.Context, push func() error) error {
+	return withRetries(ctx, job.sink.maxRetries, func() error {
+		job.sink.setStatus(func(status *sinkStatus) { status.Attempts++ })
+		return push()
+	}, func(attempt int, err error) {
+		job.sink.setStatus(func(status *sinkStatus) { status.Error = err.Error() })
+		job.log(levelWarn, "sink push failed", "sink", job.sink.options.Type, "attempt", attempt, "error", err)
+	})
+}
+
+// withRetries calls call until it succeeds, at most 1+maxRetries times, waiting
+// longer after each failure. failed is called with each error
+func withRetries(ctx context.Context, maxRetries int, call func() error, failed func(attempt int, err error)) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil {
+			return nil
+		}
+		failed(attempt, err)
+		if attempt > maxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Job stopped: %v", err)
+		case <-time.After(retryBackoff * time.Duration(attempt)):
+		}
+	}
+}
+
+// pushBatches POSTs outputs to the HTTP sink as JSON arrays, signed like webhook calls.
+// The PMMAP-batch header numbers batches from 0, the last one has PMMAP-last-batch (it may be empty)
+func (job *Job) pushBatches(ctx context.Context) error {
+	batch := make([]kvJSON, 0, job.sink.options.BatchSize)
+	number := 0
+	send := func(last bool) error {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		err = job.withSinkRetries(ctx, func() error { return job.postBatch(ctx, body, number, last) })
+		if err != nil {
+			return err
+		}
+		count := len(batch)
+		job.sink.setStatus(func(status *sinkStatus) { status.Outputs += count })
+		batch = batch[:0]
+		number++
+		return nil
+	}
+	err := job.EachOutput(func(output *Output) error {
+		batch = append(batch, outputJSON(output))
+		if len(batch) < job.sink.options.BatchSize {
+			return nil
+		}
+		return send(false)
+	})
+	if err != nil {
+		return err
+	}
+	return send(true)
+}
+
+func (job *Job) postBatch(ctx context.Context, body []byte, number int, last bool) error {
+	req, err := http.NewRequest("POST", job.sink.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range job.sink.options.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("PMMAP-job", job.ID)
+	req.Header.Set("PMMAP-batch", strconv.Itoa(number))
+	if last {
+		req.Header.Set("PMMAP-last-batch", "true")
+	}
+	signature.SignRequest(req, job.secretKey, body, time.Now())
+	res, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Sink replied %s to batch %d", res.Status, number)
+	}
+	return nil
+}
+
+// exportNDJSON writes all outputs as NDJSON, returns the number of outputs
+func (job *Job) exportNDJSON(out io.Writer) (int, error) {
+	exporter := newOutputExporter(formatNDJSON, nil, out)
+	err := job.EachOutput(exporter.write)
+	return exporter.count, err
+}
+
+// sinkPath returns the path of the file sink, always in the sink directory
+func (job *Job) sinkPath() string {
+	path := strings.Replace(job.sink.options.Path, jobIDPlaceholder, job.ID, -1)
+	return filepath.Join(config.SinkDir, filepath.Clean("/"+path))
+}
+
+// pushFile writes outputs to a temporary file, renamed once complete
+func (job *Job) pushFile() error {
+	path := job.sinkPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	count, err := job.exportNDJSON(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+	job.sink.setStatus(func(status *sinkStatus) { status.Outputs = count })
+	return nil
+}
+
+// pushS3 uploads outputs as an NDJSON object. They're written to a temporary
+// file first, as S3 needs the length and the hash of the object
+func (job *Job) pushS3(ctx context.Context) error {
+	file, err := ioutil.TempFile(config.DataDir, "sink")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	digest := sha256.New()
+	count, err := job.exportNDJSON(io.MultiWriter(file, digest))
+	if err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	options := job.sink.options
+	key := strings.Replace(options.Key, jobIDPlaceholder, job.ID, -1)
+	u, _ := url.Parse(strings.TrimSuffix(options.Endpoint, "/"))
+	u.Path += "/" + options.Bucket + "/" + strings.TrimPrefix(key, "/")
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequest("PUT", u.String(), ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", formatTypes[formatNDJSON])
+	signS3Request(req, hex.EncodeToString(digest.Sum(nil)), options.Region, options.AccessKey, options.SecretKey, time.Now())
+	res, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	reply, _ := ioutil.ReadAll(io.LimitReader(res.Body, attemptBodyLimit))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 replied %s: %s", res.Status, string(reply))
+	}
+	job.sink.setStatus(func(status *sinkStatus) { status.Outputs = count })
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runSinkJob runs a job with 3 inputs and a sink, and waits until outputs are pushed
+func runSinkJob(t *testing.T, options sinkJSON) *Job {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`"ok"`))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.sink, err = newSink(&options); err != nil {
+		t.Fatal(err)
+	}
+	job.Start(1)
+	for _, key := range []string{"a", "b", "c"} {
+		job.AddToJob(key, []byte(`1`))
+	}
+	job.AllInputsWereSent()
+	<-job.done
+	return job
+}
+
+func TestHTTPSink(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	var lock sync.Mutex
+	var batches []string
+	failed := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !failed { // the first push is retried
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []kvJSON
+		json.NewDecoder(req.Body).Decode(&batch)
+		batches = append(batches, req.Header.Get("PMMAP-batch")+req.Header.Get("PMMAP-last-batch")+":"+string(rune('0'+len(batch))))
+	}))
+	defer target.Close()
+
+	job := runSinkJob(t, sinkJSON{Type: sinkHTTP, URL: target.URL, BatchSize: 2})
+	status := job.sink.getStatus()
+	if status.State != sinkDone || status.Outputs != 3 || status.Attempts != 3 {
+		t.Fatalf("sink status isn't right: %+v", status)
+	}
+	if strings.Join(batches, ",") != "0:2,1true:1" {
+		t.Fatalf("outputs should be pushed in 2 batches: %v", batches)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	if _, err := newSink(&sinkJSON{Type: sinkFile, Path: "out.ndjson"}); err == nil {
+		t.Fatal("file sinks should be disabled without sink directory")
+	}
+	dir, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(dir)
+	defer func() { config.SinkDir = "" }()
+	config.SinkDir = dir
+
+	job := runSinkJob(t, sinkJSON{Type: sinkFile, Path: "../../results/{id}.ndjson"})
+	content, err := ioutil.ReadFile(filepath.Join(dir, "results", job.ID+".ndjson"))
+	if err != nil {
+		t.Fatalf("outputs should be written in the sink directory: %v", err)
+	}
+	if strings.Count(string(content), "\n") != 3 || job.sink.getStatus().State != sinkDone {
+		t.Fatalf("outputs should be written as NDJSON: %s", content)
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	var path, authorization string
+	var valid bool
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		hash := sha256.Sum256(body)
+		path, authorization = req.URL.EscapedPath(), req.Header.Get("Authorization")
+		valid = req.Method == "PUT" && req.Header.Get("X-Amz-Content-Sha256") == hex.EncodeToString(hash[:]) && strings.Count(string(body), "\n") == 3
+	}))
+	defer store.Close()
+
+	job := runSinkJob(t, sinkJSON{Type: sinkS3, Endpoint: store.URL, Bucket: "outputs", Key: "jobs/{id} final.ndjson", AccessKey: "AKID", SecretKey: "secret"})
+	if job.sink.getStatus().State != sinkDone || !valid {
+		t.Fatalf("outputs should be uploaded: %+v", job.sink.getStatus())
+	}
+	if path != "/outputs/jobs/"+job.ID+"%20final.ndjson" {
+		t.Fatalf("object path isn't right: %s", path)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(authorization, "/us-east-1/s3/aws4_request") {
+		t.Fatalf("upload should be signed: %s", authorization)
+	}
+}
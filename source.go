@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxSourceLine is the max size of a line of an NDJSON input source
+const maxSourceLine = 16 * 1024 * 1024
+
+// sourceTimeout is how long a source may take to reply, then to send more of its body.
+// Sources aren't read in a given time as a whole, as they may be big and wait for room in the job queue
+var sourceTimeout = 30 * time.Second
+
+// sourceClient fetches input sources, following redirects only to allowed hosts
+var sourceClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("Source redirected too many times")
+		}
+		return checkSourceURL(req.URL.String())
+	},
+}
+
+// checkSourceURL checks the URL of an input source, it must be allowed like webhooks
+func checkSourceURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Source url must be http or https")
+	}
+	if !config.AllowedWebhookHosts.allows(u.Hostname()) {
+		return fmt.Errorf("Source host %s is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// fetchSource GETs a source, and gives up when it doesn't reply or stalls for sourceTimeout
+func fetchSource(rawURL string, headers map[string]string) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	timer := time.AfterFunc(sourceTimeout, cancel)
+	res, err := sourceClient.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		err = fmt.Errorf("Source didn't reply within %v", sourceTimeout)
+	}
+	if err != nil {
+		if res != nil {
+			res.Body.Close()
+		}
+		cancel()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("Source replied %s", res.Status)
+	}
+	res.Body = &stallingBody{res.Body, cancel}
+	return res, nil
+}
+
+// stallingBody cancels the request of a source which sends nothing for sourceTimeout.
+// Only time spent waiting for the source counts, not time spent waiting for the job
+type stallingBody struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (stalling *stallingBody) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(sourceTimeout, stalling.cancel)
+	n, err := stalling.body.Read(p)
+	if !timer.Stop() {
+		return n, fmt.Errorf("Source stalled for %v", sourceTimeout)
+	}
+	return n, err
+}
+
+func (stalling *stallingBody) Close() error {
+	stalling.cancel()
+	return stalling.body.Close()
+}
+
+// addInputJSON decodes an input and adds it to a job
+func addInputJSON(job *Job, each *inputJSON) error {
+	value, err := decodeValue(each.Value, each.Encoding)
+	if err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", each.Key, err)
+	}
+	return job.AddInputsToJob([]Input{{Key: each.Key, Value: value, Priority: each.Priority}})
+}
+
+// readNDJSON reads inputs, one JSON object per line. Empty lines are skipped
+func readNDJSON(reader io.Reader, fn func(*inputJSON) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxSourceLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var each inputJSON
+		if err := json.Unmarshal(scanner.Bytes(), &each); err != nil {
+			return fmt.Errorf("Invalid input on line %d: %v", line, err)
+		}
+		if err := fn(&each); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceLimits(t *testing.T) {
+	defer func(timeout time.Duration) { sourceTimeout = timeout }(sourceTimeout)
+	sourceTimeout = 100 * time.Millisecond
+	defer func() { config.AllowedWebhookHosts = nil }()
+	config.AllowedWebhookHosts = hostList{"127.0.0.1"}
+
+	release := make(chan struct{})
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/redirect":
+			http.Redirect(w, req, "http://localhost:7777/test", http.StatusFound)
+		case "/stall":
+			w.Write([]byte("{\"key\":\"a\"}\n"))
+			w.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer source.Close()
+	defer close(release)
+
+	if _, err := fetchSource(source.URL+"/redirect", nil); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("sources shouldn't redirect to hosts which aren't allowed: %v", err)
+	}
+	res, err := fetchSource(source.URL+"/stall", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if _, err := ioutil.ReadAll(res.Body); err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("sources which stall should fail: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateDir is the directory of the data directory where the server state is saved,
+// so tenants and the like survive a restart
+const stateDir = "state"
+
+// StateError is returned when a change was made, but can't be saved
+type StateError struct {
+	Err error
+}
+
+func (err *StateError) Error() string {
+	return fmt.Sprintf("Can't save the server state: %v", err.Err)
+}
+
+// saveState writes a part of the server state as JSON. The file is replaced at once,
+// so a crash leaves the previous state. It's only readable by PMmap, as it holds tokens
+func saveState(name string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return &StateError{err}
+	}
+	dir := filepath.Join(config.DataDir, stateDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return &StateError{err}
+	}
+	path := filepath.Join(dir, name+".json")
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return &StateError{err}
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return &StateError{err}
+	}
+	return nil
+}
+
+// loadState reads a part of the server state, value is left as is when it was never saved
+func loadState(name string, value interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(config.DataDir, stateDir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, value)
+}
+
+// loadServerState restores the state saved by a previous run of the server
+func loadServerState() error {
+	if err := Tenants.load(); err != nil {
+		return err
+	}
+	if err := Templates.load(); err != nil {
+		return err
+	}
+	if err := restoreJobs(); err != nil {
+		return err
+	}
+	return Schedules.load() // their runs are restored jobs
+}
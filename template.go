@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// templateJSON is a named job configuration stored server-side
+type templateJSON struct {
+	Name string                 `json:"name"`
+	Job  map[string]interface{} `json:"job"` // like the body of POST /job
+}
+
+// templateManager holds job templates, by tenant and name
+type templateManager struct {
+	sync.RWMutex
+	templates map[string]map[string]interface{}
+}
+
+// Templates is the entry point to job templates
+var Templates = templateManager{templates: make(map[string]map[string]interface{})}
+
+func templateID(tenant *Tenant, name string) string {
+	return tenant.ID + "\x00" + name
+}
+
+// setTemplate checks a template and stores it, it replaces the template of the same name
+func (man *templateManager) setTemplate(tenant *Tenant, template *templateJSON) error {
+	if template.Name == "" || strings.Contains(template.Name, "/") {
+		return fmt.Errorf("Template name can't be empty or contain /")
+	}
+	if _, found := template.Job["template"]; found {
+		return fmt.Errorf("Templates can't use a template")
+	}
+	query, err := jobFromMap(template.Job)
+	if err != nil {
+		return err
+	}
+	if _, _, err := webhookFromQuery(query); err != nil {
+		return err
+	}
+	man.Lock()
+	defer man.Unlock()
+	man.templates[templateID(tenant, template.Name)] = template.Job
+	return saveState(templatesState, man.templates)
+}
+
+// getTemplate returns a copy of a template, nil if there's none of this name
+func (man *templateManager) getTemplate(tenant *Tenant, name string) map[string]interface{} {
+	man.RLock()
+	defer man.RUnlock()
+	job, found := man.templates[templateID(tenant, name)]
+	if !found {
+		return nil
+	}
+	return mergeJSON(nil, job)
+}
+
+// delTemplate deletes a template, returns false if there's none of this name
+func (man *templateManager) delTemplate(tenant *Tenant, name string) bool {
+	man.Lock()
+	defer man.Unlock()
+	id := templateID(tenant, name)
+	if _, found := man.templates[id]; !found {
+		return false
+	}
+	delete(man.templates, id)
+	if err := saveState(templatesState, man.templates); err != nil {
+		logEvent(levelError, "can't save templates", "error", err)
+	}
+	return true
+}
+
+// templatesState is the name of the saved templates in the state directory
+const templatesState = "templates"
+
+// load restores the templates saved by a previous run of the server
+func (man *templateManager) load() error {
+	man.Lock()
+	defer man.Unlock()
+	return loadState(templatesState, &man.templates)
+}
+
+// names returns the names of the templates of a tenant, sorted
+func (man *templateManager) names(tenant *Tenant) []string {
+	man.RLock()
+	defer man.RUnlock()
+	prefix := templateID(tenant, "")
+	result := []string{}
+	for id := range man.templates {
+		if strings.HasPrefix(id, prefix) {
+			result = append(result, id[len(prefix):])
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// overridableFields are the fields of a template which jobs may override. The others,
+// like the url and headers, can't change: the template secret would sign calls chosen by clients
+var overridableFields = []string{"attemptsRetention", "batchSize", "batchWait", "concurrency", "maxRetries", "maxsize", "timeout", "weight"}
+
+// resolveTemplate returns the job of a template with the overrides of the query.
+// Queries without template are returned as is
+func resolveTemplate(tenant *Tenant, query *createJobJSON) (*createJobJSON, error) {
+	if query.Template == "" {
+		return query, nil
+	}
+	for name := range query.Overrides {
+		if !isOverridable(name) {
+			return nil, fmt.Errorf("%s can't be overridden, only %s", name, strings.Join(overridableFields, ", "))
+		}
+	}
+	job := Templates.getTemplate(tenant, query.Template)
+	if job == nil {
+		return nil, fmt.Errorf("Unknown template %s", query.Template)
+	}
+	job = mergeJSON(job, query.Overrides)
+	delete(job, "template")
+	delete(job, "overrides")
+	return jobFromMap(job)
+}
+
+func isOverridable(name string) bool {
+	for _, each := range overridableFields {
+		if each == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jobFromMap decodes a job from a decoded JSON object
+func jobFromMap(job map[string]interface{}) (*createJobJSON, error) {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	query := &createJobJSON{}
+	if err := json.Unmarshal(content, query); err != nil {
+		return nil, fmt.Errorf("Invalid job: %v", err)
+	}
+	return query, nil
+}
+
+// mergeJSON returns a copy of base with the members of overrides: objects are merged, other values replaced
+func mergeJSON(base map[string]interface{}, overrides map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(overrides))
+	for name, value := range base {
+		if object, ok := value.(map[string]interface{}); ok {
+			value = mergeJSON(object, nil)
+		}
+		result[name] = value
+	}
+	for name, value := range overrides {
+		object, isObject := value.(map[string]interface{})
+		baseObject, baseIsObject := result[name].(map[string]interface{})
+		switch {
+		case isObject && baseIsObject:
+			result[name] = mergeJSON(baseObject, object)
+		case isObject:
+			result[name] = mergeJSON(object, nil)
+		default:
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// redacted replaces secrets in templates read by clients
+const redacted = "********"
+
+// redactTemplate hides the secrets of a template, so they only live on the server:
+// the job secret, the TLS client key, the S3 secret key and header values
+func redactTemplate(job map[string]interface{}) map[string]interface{} {
+	hide := func(object map[string]interface{}, names ...string) {
+		for _, name := range names {
+			if _, found := object[name]; found {
+				object[name] = redacted
+			}
+		}
+		if headers, ok := object["headers"].(map[string]interface{}); ok {
+			for name := range headers {
+				headers[name] = redacted
+			}
+		}
+	}
+	hide(job, "secret")
+	if tls, ok := job["tls"].(map[string]interface{}); ok {
+		hide(tls, "key")
+	}
+	if sink, ok := job["sink"].(map[string]interface{}); ok {
+		hide(sink, "secretKey")
+	}
+	return job
+}
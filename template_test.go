@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	template := `{"name":"crawler","job":{"secret":"` + Secret + `","url":"http://localhost:7777/test","maxsize":10,"concurrency":2,` +
+		`"headers":{"X-Api-Key":"key","X-Team":"crawl"}}}`
+	res, err := http.Post("http://localhost:8080/template", "application/json", bytes.NewReader([]byte(template)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("template should be stored (%v)", err)
+	}
+	defer Templates.delTemplate(Tenants.tenants[DefaultTenantID], "crawler")
+
+	res, _ = http.Get("http://localhost:8080/template/crawler")
+	var stored templateJSON
+	json.NewDecoder(res.Body).Decode(&stored)
+	if stored.Job["secret"] != redacted || stored.Job["headers"].(map[string]interface{})["X-Api-Key"] != redacted || stored.Job["maxsize"] != 10.0 {
+		t.Fatalf("templates should be read without their secrets: %+v", stored)
+	}
+	restored := templateManager{templates: make(map[string]map[string]interface{})}
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if job := restored.getTemplate(Tenants.tenants[DefaultTenantID], "crawler"); job == nil || job["secret"] != Secret {
+		t.Fatalf("templates should be restored with their secrets: %+v", job)
+	}
+
+	for _, overrides := range []string{`{"url":"http://example.com/steal"}`, `{"headers":{"X-Team":"urgent"}}`, `{"plaintextSecret":true}`} {
+		query := `{"template":"crawler","overrides":` + overrides + `}`
+		res, _ := http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(query)))
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("overrides %s should be rejected", overrides)
+		}
+	}
+
+	query := `{"template":"crawler","overrides":{"concurrency":1,"maxsize":5}}`
+	res, err = http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(query)))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("job should be created from the template (%v)", err)
+	}
+	var created struct{ ID string }
+	json.NewDecoder(res.Body).Decode(&created)
+	job := Manager.getJob(created.ID)
+	defer func() {
+		job.AllInputsWereSent()
+		<-job.Complete
+		Manager.delJob(job.ID)
+	}()
+	if job.secretKey != Secret || job.request.headers["X-Api-Key"] != "key" || job.request.headers["X-Team"] != "crawl" || job.queue.capacity != 5 {
+		t.Fatalf("the job should have the template with its overrides: %+v", job.request.headers)
+	}
+
+	res, _ = http.Post("http://localhost:8080/job", "application/json", bytes.NewReader([]byte(`{"template":"unknown"}`)))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("unknown templates should be rejected")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultTenantID is the ID of the tenant used when requests don't identify one
+const DefaultTenantID = "default"
+
+// QuotaError is returned when a tenant would exceed one of its quotas
+type QuotaError struct {
+	Tenant string
+	Quota  string
+}
+
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("Tenant %s exceeded its %s quota", err.Tenant, err.Quota)
+}
+
+// Tenant is a user of PMmap, with its own quotas. A limit of 0 means unlimited
+type Tenant struct {
+	ID              string
+	token           string // the API token identifying the tenant, optional
+	MaxJobs         int64  // max number of running jobs
+	MaxInflight     int64  // max number of concurrent webhook calls
+	MaxQueuedInputs int64  // max number of inputs waiting to be sent to webhooks
+	MaxDiskUsage    int64  // max number of bytes used to store outputs
+
+	jobs         int64 // counts running jobs
+	inflight     int64 // counts webhook calls in progress
+	queuedInputs int64 // counts inputs waiting in jobs
+	diskUsage    int64 // counts bytes of outputs stored
+}
+
+// MarshalJSON gives a JSON representation of a Tenant and its usage
+func (tenant *Tenant) MarshalJSON() ([]byte, error) {
+	type limits struct {
+		Jobs         int64 `json:"jobs"`
+		Inflight     int64 `json:"inflight"`
+		QueuedInputs int64 `json:"queuedInputs"`
+		DiskUsage    int64 `json:"diskUsage"`
+	}
+	return json.Marshal(&struct {
+		ID     string `json:"id"`
+		Usage  limits `json:"usage"`
+		Limits limits `json:"limits"`
+	}{
+		tenant.ID,
+		limits{
+			atomic.LoadInt64(&tenant.jobs),
+			atomic.LoadInt64(&tenant.inflight),
+			atomic.LoadInt64(&tenant.queuedInputs),
+			atomic.LoadInt64(&tenant.diskUsage),
+		},
+		limits{
+			atomic.LoadInt64(&tenant.MaxJobs),
+			atomic.LoadInt64(&tenant.MaxInflight),
+			atomic.LoadInt64(&tenant.MaxQueuedInputs),
+			atomic.LoadInt64(&tenant.MaxDiskUsage),
+		},
+	})
+}
+
+// startJob reserves a running job for the tenant
+func (tenant *Tenant) startJob() error {
+	if err := tenant.checkDiskUsage(); err != nil {
+		return err
+	}
+	max := atomic.LoadInt64(&tenant.MaxJobs)
+	if atomic.AddInt64(&tenant.jobs, 1) > max && max > 0 {
+		atomic.AddInt64(&tenant.jobs, -1)
+		return &QuotaError{tenant.ID, "jobs"}
+	}
+	return nil
+}
+
+// jobFinished releases a running job reserved with startJob
+func (tenant *Tenant) jobFinished() {
+	atomic.AddInt64(&tenant.jobs, -1)
+}
+
+// queueInputs reserves room for count inputs waiting to be sent
+func (tenant *Tenant) queueInputs(count int) error {
+	if err := tenant.checkDiskUsage(); err != nil {
+		return err
+	}
+	max := atomic.LoadInt64(&tenant.MaxQueuedInputs)
+	if atomic.AddInt64(&tenant.queuedInputs, int64(count)) > max && max > 0 {
+		atomic.AddInt64(&tenant.queuedInputs, -int64(count))
+		return &QuotaError{tenant.ID, "queued inputs"}
+	}
+	return nil
+}
+
+// requeueInput counts an input sent back to the queue, without checking quotas
+func (tenant *Tenant) requeueInput() {
+	atomic.AddInt64(&tenant.queuedInputs, 1)
+}
+
+// inputsDequeued is called when inputs leave the queue
+func (tenant *Tenant) inputsDequeued(count int) {
+	atomic.AddInt64(&tenant.queuedInputs, -int64(count))
+}
+
+// addDiskUsage counts bytes stored (or freed, when negative) for the tenant
+func (tenant *Tenant) addDiskUsage(count int64) {
+	atomic.AddInt64(&tenant.diskUsage, count)
+}
+
+// checkDiskUsage returns an error if the tenant already used all its disk quota
+func (tenant *Tenant) checkDiskUsage() error {
+	max := atomic.LoadInt64(&tenant.MaxDiskUsage)
+	if max > 0 && atomic.LoadInt64(&tenant.diskUsage) >= max {
+		return &QuotaError{tenant.ID, "disk usage"}
+	}
+	return nil
+}
+
+// tenantManager holds tenants
+type tenantManager struct {
+	sync.RWMutex
+	tenants map[string]*Tenant
+	tokens  map[string]*Tenant
+}
+
+// Tenants is the entry point to tenants, it always contains the default tenant
+var Tenants = tenantManager{
+	tenants: map[string]*Tenant{DefaultTenantID: {ID: DefaultTenantID}},
+	tokens:  make(map[string]*Tenant),
+}
+
+// setTenant creates a tenant, or updates its token and limits if it exists, then saves all tenants.
+// The tenant is set even if it can't be saved
+func (man *tenantManager) setTenant(id string, token string, limits Tenant) (*Tenant, error) {
+	man.Lock()
+	defer man.Unlock()
+	tenant := man.set(id, token, limits)
+	return tenant, man.save()
+}
+
+// set creates or updates a tenant, must be called with the lock held
+func (man *tenantManager) set(id string, token string, limits Tenant) *Tenant {
+	tenant, ok := man.tenants[id]
+	if !ok {
+		tenant = &Tenant{ID: id}
+		man.tenants[id] = tenant
+	}
+	if tenant.token != "" {
+		delete(man.tokens, tenant.token)
+	}
+	tenant.token = token
+	if token != "" {
+		man.tokens[token] = tenant
+	}
+	atomic.StoreInt64(&tenant.MaxJobs, limits.MaxJobs)
+	atomic.StoreInt64(&tenant.MaxInflight, limits.MaxInflight)
+	atomic.StoreInt64(&tenant.MaxQueuedInputs, limits.MaxQueuedInputs)
+	atomic.StoreInt64(&tenant.MaxDiskUsage, limits.MaxDiskUsage)
+	return tenant
+}
+
+// tenantsState is the name of the saved tenants in the state directory
+const tenantsState = "tenants"
+
+// save writes the tokens and limits of all tenants, must be called with the lock held
+func (man *tenantManager) save() error {
+	saved := make(map[string]tenantJSON, len(man.tenants))
+	for id, tenant := range man.tenants {
+		saved[id] = tenantJSON{
+			Token:           tenant.token,
+			MaxJobs:         atomic.LoadInt64(&tenant.MaxJobs),
+			MaxInflight:     atomic.LoadInt64(&tenant.MaxInflight),
+			MaxQueuedInputs: atomic.LoadInt64(&tenant.MaxQueuedInputs),
+			MaxDiskUsage:    atomic.LoadInt64(&tenant.MaxDiskUsage),
+		}
+	}
+	return saveState(tenantsState, saved)
+}
+
+// load declares the tenants saved by a previous run of the server
+func (man *tenantManager) load() error {
+	saved := make(map[string]tenantJSON)
+	if err := loadState(tenantsState, &saved); err != nil {
+		return err
+	}
+	man.Lock()
+	defer man.Unlock()
+	for id, each := range saved {
+		man.set(id, each.Token, Tenant{
+			MaxJobs:         each.MaxJobs,
+			MaxInflight:     each.MaxInflight,
+			MaxQueuedInputs: each.MaxQueuedInputs,
+			MaxDiskUsage:    each.MaxDiskUsage,
+		})
+	}
+	return nil
+}
+
+// getTenant returns a tenant from its ID, nil if there's none
+func (man *tenantManager) getTenant(id string) *Tenant {
+	man.RLock()
+	defer man.RUnlock()
+	return man.tenants[id]
+}
+
+// configureDefault sets the quotas of the default tenant from the configuration, it keeps its token
+func (man *tenantManager) configureDefault() {
+	man.Lock()
+	defer man.Unlock()
+	man.set(DefaultTenantID, man.tenants[DefaultTenantID].token, Tenant{
+		MaxJobs:         config.DefaultMaxJobs,
+		MaxInflight:     config.DefaultMaxInflight,
+		MaxQueuedInputs: config.DefaultMaxQueued,
+		MaxDiskUsage:    config.DefaultMaxDiskUsage,
+	})
+}
+
+// identify finds the tenant of a request from its API token or its tenant ID.
+// Tenants with a token can only be identified by their token
+func (man *tenantManager) identify(token string, id string) (*Tenant, error) {
+	man.RLock()
+	defer man.RUnlock()
+	if token != "" {
+		if tenant, ok := man.tokens[token]; ok {
+			return tenant, nil
+		}
+		return nil, fmt.Errorf("Unknown API token")
+	}
+	if id == "" {
+		id = DefaultTenantID
+	}
+	tenant, ok := man.tenants[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tenant %s", id)
+	}
+	if tenant.token != "" {
+		return nil, fmt.Errorf("Tenant %s must be identified by its API token", id)
+	}
+	return tenant, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestTenantQuotas tests that a tenant can't run more jobs than its quota, and can read its usage
+func TestTenantQuotas(t *testing.T) {
+	defer func() { config.AdminToken = "" }()
+	config.AdminToken = "admin-token"
+	defer Tenants.setTenant("quota", "", Tenant{}) // lets the test run again
+	b, _ := json.Marshal(tenantJSON{Token: "quota-token", MaxJobs: 1})
+	for _, token := range []string{"", "quota-token"} {
+		putreq, _ := http.NewRequest("PUT", "http://localhost:8080/tenant/quota", bytes.NewReader(b))
+		putreq.Header.Set("PMMAP-admin-token", token)
+		if putres, puterr := http.DefaultClient.Do(putreq); puterr != nil || putres.StatusCode != http.StatusUnauthorized {
+			t.Fatal("PUT tenant should require the admin token ", puterr)
+		}
+	}
+	putreq, _ := http.NewRequest("PUT", "http://localhost:8080/tenant/quota", bytes.NewReader(b))
+	putreq.Header.Set("PMMAP-admin-token", "admin-token")
+	putres, puterr := http.DefaultClient.Do(putreq)
+	if puterr != nil || putres.StatusCode != http.StatusOK {
+		t.Fatal("PUT tenant should reply with 200 ", puterr)
+	}
+
+	create := func(token string) int {
+		b, _ := json.Marshal(createJobJSON{URL: "http://" + localServerAddress + webhook, Secret: Secret, Maxsize: 1, Concurrency: 1})
+		req, _ := http.NewRequest("POST", "http://localhost:8080/job", bytes.NewReader(b))
+		req.Header.Set("PMMAP-token", token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var created struct{ ID string }
+		if json.NewDecoder(res.Body).Decode(&created) == nil && created.ID != "" {
+			t.Cleanup(func() { Manager.delJob(created.ID) })
+		}
+		return res.StatusCode
+	}
+	if code := create("quota-token"); code != http.StatusCreated {
+		t.Fatalf("first job should have been created, got %d", code)
+	}
+	if code := create("quota-token"); code != http.StatusTooManyRequests {
+		t.Fatalf("second job should have exceeded the quota, got %d", code)
+	}
+	if code := create("bad-token"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown tokens should be rejected, got %d", code)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/tenant/quota/usage", nil)
+	req.Header.Set("PMMAP-token", "quota-token")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatal("GET usage should reply with 200 ", err)
+	}
+	var usage struct {
+		Usage struct {
+			Jobs int `json:"jobs"`
+		} `json:"usage"`
+	}
+	json.NewDecoder(res.Body).Decode(&usage)
+	if usage.Usage.Jobs != 1 {
+		t.Fatalf("tenant should have 1 running job, it has %d", usage.Usage.Jobs)
+	}
+}
+
+// TestDefaultTenant tests that the default tenant gets its quotas from the configuration,
+// and that requests without headers are rejected once it has a token
+func TestDefaultTenant(t *testing.T) {
+	defer func() {
+		config.DefaultMaxJobs, config.AdminToken = 0, ""
+		Tenants.setTenant(DefaultTenantID, "", Tenant{})
+	}()
+	config.DefaultMaxJobs = 3
+	Tenants.configureDefault()
+	if tenant, _ := Tenants.identify("", ""); tenant.MaxJobs != 3 {
+		t.Fatalf("the default tenant should have the quotas of the configuration: %d jobs", tenant.MaxJobs)
+	}
+
+	config.AdminToken = "admin-token"
+	b, _ := json.Marshal(tenantJSON{Token: "default-token", MaxJobs: 3})
+	req, _ := http.NewRequest("PUT", "http://localhost:8080/tenant/"+DefaultTenantID, bytes.NewReader(b))
+	req.Header.Set("PMMAP-admin-token", "admin-token")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatal("PUT tenant should reply with 200 ", err)
+	}
+	Tenants.configureDefault()
+	if res, err := http.Get("http://localhost:8080/job/unknown"); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("requests without token should be rejected once the default tenant has one")
+	}
+	if tenant, err := Tenants.identify("default-token", ""); err != nil || tenant.ID != DefaultTenantID {
+		t.Fatal("the default tenant should keep its token ", err)
+	}
+}
+
+// TestTenantsState tests that tenants are saved, and declared again by the next run of the server
+func TestTenantsState(t *testing.T) {
+	defer Tenants.setTenant("saved", "", Tenant{})
+	if _, err := Tenants.setTenant("saved", "saved-token", Tenant{MaxJobs: 2, MaxDiskUsage: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	restored := tenantManager{tenants: make(map[string]*Tenant), tokens: make(map[string]*Tenant)}
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := restored.identify("saved-token", "")
+	if err != nil || tenant.ID != "saved" || tenant.MaxJobs != 2 || tenant.MaxDiskUsage != 1000 {
+		t.Fatalf("the tenant should be restored with its token and limits: %+v (%v)", tenant, err)
+	}
+}
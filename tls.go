@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// webhookTLSJSON holds the TLS options of a job for calling its webhook
+type webhookTLSJSON struct {
+	Cert       string `json:"cert"`       // PEM client certificate, for webhooks requiring mTLS
+	Key        string `json:"key"`        // PEM private key of the client certificate
+	CA         string `json:"ca"`         // PEM CA bundle used instead of the system roots
+	ServerName string `json:"serverName"` // overrides the server name checked in the webhook certificate
+}
+
+// config returns the TLS configuration for calling the webhook
+func (options *webhookTLSJSON) config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: options.ServerName}
+	if options.Cert != "" || options.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(options.Cert), []byte(options.Key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if options.CA != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(options.CA)) {
+			return nil, fmt.Errorf("Invalid TLS CA bundle: no PEM certificate found")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// transport returns an HTTP transport using the TLS configuration of the options
+func (options *webhookTLSJSON) transport() (*http.Transport, error) {
+	tlsConfig, err := options.config()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the API server.
+// If clientCAFile is set, clients must present a certificate signed by one of its CAs
+func serverTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read TLS client CA file: %v", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Invalid TLS client CA file %s: no PEM certificate found", clientCAFile)
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestWebhookCustomCA tests that a job can call a webhook whose certificate is signed by a custom CA
+func TestWebhookCustomCA(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`"secured"`))
+	}))
+	defer backend.Close()
+
+	options := &webhookTLSJSON{
+		CA:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})),
+		ServerName: "example.com",
+	}
+	transport, err := options.transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(backend.URL)
+	job, err := CreateJob(Tenants.tenants[DefaultTenantID], Secret, *u, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.client.Transport = transport
+	job.Start(1)
+	job.AddToJob("hello", []byte("world"))
+	job.AllInputsWereSent()
+	<-job.Complete
+	if string(job.GetResult("hello")) != `"secured"` {
+		t.Fatalf("result should been returned (%s)", string(job.GetResult("hello")))
+	}
+
+	if _, err := (&webhookTLSJSON{CA: "not a certificate"}).config(); err == nil {
+		t.Fatal("invalid CA bundle should be rejected")
+	}
+}
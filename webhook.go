@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// keyPlaceholder is replaced by the escaped input key in webhook URLs
+const keyPlaceholder = "{key}"
+
+// webhookRequest describes how inputs are sent to the webhook
+type webhookRequest struct {
+	method      string             // the HTTP method
+	contentType string             // the content type of request bodies
+	raw         string             // the URL, as given when creating the job
+	url         string             // the URL, where keyPlaceholder is replaced by the key
+	headers     map[string]string  // static headers added to each request
+	body        *template.Template // the body template, the raw value is sent if nil
+}
+
+// bodyData is what body templates can use
+type bodyData struct {
+	Key   string
+	Value string // the raw value, usually JSON
+}
+
+var bodyFuncs = template.FuncMap{
+	// json encodes a string as JSON, like {"id": {{json .Key}}}
+	"json": func(value string) (string, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+}
+
+// newWebhookRequest checks and parses the webhook request options of a job.
+// Without keyPlaceholder in rawURL, the escaped key is added as the last path segment
+func newWebhookRequest(method string, rawURL string, headers map[string]string, body *string) (*webhookRequest, error) {
+	if method == "" {
+		method = "POST"
+	}
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return nil, fmt.Errorf("Unsupported webhook method %s", method)
+	}
+	request := &webhookRequest{method: method, contentType: "application/json", raw: rawURL, url: rawURL, headers: headers}
+	if !strings.Contains(rawURL, keyPlaceholder) {
+		request.url = strings.TrimSuffix(rawURL, "/") + "/" + keyPlaceholder
+	}
+	if strings.Contains(strings.SplitN(request.url, keyPlaceholder, 2)[0], "#") {
+		return nil, fmt.Errorf("Webhook URL can't have %s in its fragment", keyPlaceholder)
+	}
+	if _, err := request.parsedURL("key"); err != nil {
+		return nil, err
+	}
+	for name := range headers {
+		if strings.HasPrefix(strings.ToLower(name), "pmmap-") {
+			return nil, fmt.Errorf("Webhook header %s is reserved", name)
+		}
+	}
+	if body != nil {
+		var err error
+		if request.body, err = template.New("body").Funcs(bodyFuncs).Parse(*body); err != nil {
+			return nil, fmt.Errorf("Invalid body template: %v", err)
+		}
+	}
+	return request, nil
+}
+
+// urlFor returns the webhook URL for a key. The key is escaped as a path
+// segment when the placeholder is in the path, as a query value otherwise
+func (request *webhookRequest) urlFor(key string) string {
+	var result bytes.Buffer
+	parts := strings.Split(request.url, keyPlaceholder)
+	inQuery := false
+	for index, part := range parts {
+		if index > 0 {
+			if inQuery {
+				result.WriteString(url.QueryEscape(key))
+			} else {
+				result.WriteString(url.PathEscape(key))
+			}
+		}
+		result.WriteString(part)
+		inQuery = inQuery || strings.Contains(part, "?")
+	}
+	return result.String()
+}
+
+// parsedURL returns the parsed webhook URL for a key
+func (request *webhookRequest) parsedURL(key string) (*url.URL, error) {
+	u, err := url.Parse(request.urlFor(key))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Webhook URL must be http or https")
+	}
+	return u, nil
+}
+
+// bodyFor returns the request body for an input.
+// Without body template, GET requests have no body and the other methods send the raw value
+func (request *webhookRequest) bodyFor(input Input) ([]byte, error) {
+	if request.body == nil {
+		if request.method == "GET" {
+			return nil, nil
+		}
+		return input.Value, nil
+	}
+	var result bytes.Buffer
+	if err := request.body.Execute(&result, bodyData{input.Key, string(input.Value)}); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+// newRequest builds the HTTP request for an input, and returns its body
+func (request *webhookRequest) newRequest(input Input) (*http.Request, []byte, error) {
+	body, err := request.bodyFor(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := request.build(request.urlFor(input.Key), request.contentType, body)
+	return req, body, err
+}
+
+// newBatchRequest builds the HTTP request for a batch of inputs, sent as a JSON array
+// of {key, value} to the webhook URL, and returns its body
+func (request *webhookRequest) newBatchRequest(inputs []Input) (*http.Request, []byte, error) {
+	batch := make([]kvJSON, len(inputs))
+	for index, input := range inputs {
+		value, encoding := encodeValue(input.Value, request.contentType)
+		batch[index] = kvJSON{Key: input.Key, Value: value, Encoding: encoding}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := request.build(request.raw, "application/json", body)
+	return req, body, err
+}
+
+// build creates a webhook request with the static headers
+func (request *webhookRequest) build(url string, contentType string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(request.method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range request.headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
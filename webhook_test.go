@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWebhookURLs(t *testing.T) {
+	for _, test := range []struct{ url, key, expected string }{
+		{"http://backend/work", "a/b?c", "http://backend/work/a%2Fb%3Fc"},
+		{"http://backend/work/", "hello", "http://backend/work/hello"},
+		{"http://backend/items/{key}/check", "a b", "http://backend/items/a%20b/check"},
+		{"http://backend/search?q={key}&page=1", "a&b=c", "http://backend/search?q=a%26b%3Dc&page=1"},
+	} {
+		request, err := newWebhookRequest("", test.url, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := request.urlFor(test.key); result != test.expected {
+			t.Fatalf("URL for %s with %s should be %s, not %s", test.key, test.url, test.expected, result)
+		}
+	}
+
+	if _, err := newWebhookRequest("TRACE", "http://backend", nil, nil); err == nil {
+		t.Fatal("unsupported methods should be rejected")
+	}
+	if _, err := newWebhookRequest("", "ftp://backend", nil, nil); err == nil {
+		t.Fatal("only http and https should be accepted")
+	}
+	if _, err := newWebhookRequest("", "http://backend", map[string]string{"PMMAP-auth": "x"}, nil); err == nil {
+		t.Fatal("PMMAP headers should be reserved")
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	template := `{"id": {{json .Key}}, "data": {{.Value}}}`
+	request, err := newWebhookRequest("put", "http://backend/{key}", map[string]string{"X-Api-Key": "secret"}, &template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, body, err := request.newRequest(Input{Key: `say "hi"`, Value: []byte(`[1,2]`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "PUT" || req.Header.Get("X-Api-Key") != "secret" {
+		t.Fatalf("method and headers should be set: %s %v", req.Method, req.Header)
+	}
+	if string(body) != `{"id": "say \"hi\"", "data": [1,2]}` {
+		t.Fatalf("body template should wrap the value: %s", string(body))
+	}
+
+	get, _ := newWebhookRequest("GET", "http://backend/{key}", nil, nil)
+	if _, body, _ := get.newRequest(Input{Key: "k", Value: []byte(`"v"`)}); body != nil {
+		t.Fatalf("GET requests shouldn't have a body without template: %s", string(body))
+	}
+}